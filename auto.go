@@ -0,0 +1,146 @@
+package bobstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Objective of an AutoCodec
+type Objective int
+
+const (
+	// Smallest chooses the codec giving the smallest result
+	Smallest Objective = iota
+
+	// SmallestWithinBudget chooses the codec giving the smallest result
+	// among the codecs encoding within the Budget.  If none does, the
+	// fastest codec is chosen.
+	SmallestWithinBudget
+)
+
+// AutoCodec chooses the codec for every blob from its candidates.
+//
+// The chosen codec is recorded in the header like for any other codec,
+// so reading needs no AutoCodec.  Use Codec() for writing:
+//
+//	auto := NewAutoCodec(SnappyCodec(), GZIPCodec())
+//	ref, err := db.WriteWithCodec(b, auto.Codec())
+type AutoCodec struct {
+	// Candidates to choose from
+	Candidates []*Codec
+
+	// Objective for choosing
+	Objective Objective
+
+	// Budget is the encoding time allowed per MB of input for SmallestWithinBudget
+	Budget time.Duration
+
+	// SampleEvery - only try all candidates for every n-th blob,
+	// the others are encoded with the last choice.  0 tries every blob.
+	SampleEvery int
+
+	lock   sync.Mutex
+	codec  *Codec
+	n      int
+	last   *Codec
+	chosen map[string]uint64
+}
+
+// NewAutoCodec returns an AutoCodec choosing the Smallest result of the candidates
+func NewAutoCodec(candidates ...*Codec) *AutoCodec {
+	return &AutoCodec{Candidates: candidates}
+}
+
+// Codec returns the codec for writing
+func (a *AutoCodec) Codec() *Codec {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.codec == nil {
+		a.codec = &Codec{typ: "AUTO", choose: a.choose}
+	}
+	return a.codec
+}
+
+// Stats returns how often each codec (by typ) was chosen
+func (a *AutoCodec) Stats() map[string]uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	stats := make(map[string]uint64, len(a.chosen))
+	for typ, n := range a.chosen {
+		stats[typ] = n
+	}
+	return stats
+}
+
+func (a *AutoCodec) choose(src []byte) (*Codec, []byte, error) {
+	if len(a.Candidates) == 0 {
+		return nil, nil, errors.New("auto codec without candidates")
+	}
+
+	a.lock.Lock()
+	last := a.last
+	sample := last == nil || a.SampleEvery <= 1 || a.n%a.SampleEvery == 0
+	a.n++
+	a.lock.Unlock()
+
+	var used *Codec
+	var dst []byte
+	var err error
+	if sample {
+		used, dst, err = a.try(src)
+	} else {
+		used, dst, err = last.encode(src)
+	}
+	if err != nil {
+		return used, nil, err
+	}
+
+	a.lock.Lock()
+	if sample {
+		a.last = used
+	}
+	if a.chosen == nil {
+		a.chosen = make(map[string]uint64)
+	}
+	a.chosen[used.typ]++
+	a.lock.Unlock()
+
+	return used, dst, nil
+}
+
+// try all candidates and choose by the objective
+func (a *AutoCodec) try(src []byte) (*Codec, []byte, error) {
+	// allowed encoding time for src
+	budget := time.Duration(float64(a.Budget) * float64(len(src)) / (1024 * 1024))
+
+	var best, fastest *Codec
+	var bestDst, fastestDst []byte
+	var fastestTime time.Duration
+	for _, candidate := range a.Candidates {
+		start := time.Now()
+		used, dst, err := candidate.encode(src)
+		elapsed := time.Since(start)
+		if err != nil {
+			return used, nil, err
+		}
+
+		if fastest == nil || elapsed < fastestTime {
+			fastest, fastestDst, fastestTime = used, dst, elapsed
+		}
+		if a.Objective == SmallestWithinBudget && elapsed > budget {
+			continue
+		}
+		if best == nil || len(dst) < len(bestDst) {
+			best, bestDst = used, dst
+		}
+	}
+
+	if best == nil {
+		return fastest, fastestDst, nil
+	}
+	return best, bestDst, nil
+}
@@ -0,0 +1,295 @@
+package bobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// backupManifestFile is the name of the backup manifest in a backup directory
+const backupManifestFile = "_backup"
+
+// BackupManifest describes a backup directory.
+//
+// A backup holds the bytes of the data files from Since up to Watermark,
+// one file per data file with the same name.  Incremental backups are
+// made with the watermark of the previous backup as since.
+type BackupManifest struct {
+	// Since is where the backup starts, null for a full backup
+	Since Ref `json:"since"`
+	// Watermark: all blobs before it are in the backup and its predecessors
+	Watermark Ref `json:"watermark"`
+	// Files are the pieces of the data files in the backup
+	Files []BackupFile `json:"files"`
+
+	// the manifest of the db
+	Manifest *manifest `json:"manifest"`
+}
+
+// BackupFile is the piece [Start, End) of a data file
+type BackupFile struct {
+	Fno   uint32 `json:"fno"`
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	// SHA256 of the piece, hex encoded
+	SHA256 string `json:"sha256"`
+}
+
+// Backup copies the blobs from since to dest, a null since means all blobs.
+//
+// Data files that are complete are copied wholesale, the active file
+// up to the position where all records are completely written.
+// Refs stay the same, see Restore.  The returned manifest is also
+// written to dest, its watermark is the since for the next backup.
+func (db *DB) Backup(dest string, since Ref) (*BackupManifest, error) {
+	since = Ref{Fno: since.Fno, Pos: since.Pos}
+
+	watermark, err := committedWatermark(db)
+	if err != nil {
+		return nil, err
+	}
+	if watermark.Less(since) {
+		return nil, errors.Errorf("since %s is after the end of the db %s", since, watermark)
+	}
+
+	err = os.MkdirAll(dest, 0777)
+	if err != nil {
+		return nil, errors.Wrap(err, "mkdir failed")
+	}
+
+	db.lock.Lock()
+	m := *db.manifest
+	db.lock.Unlock()
+	bm := &BackupManifest{Since: since, Watermark: watermark, Manifest: &m}
+
+	fnos, err := dataFiles(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, fno := range fnos {
+		if fno < since.Fno || fno > watermark.Fno {
+			continue
+		}
+
+		var start, end uint32
+		if fno == since.Fno {
+			start = since.Pos
+		}
+		if fno == watermark.Fno {
+			end = watermark.Pos
+		} else {
+			size, err := dataFileSize(db, fno)
+			if err != nil {
+				return nil, err
+			}
+			end = uint32(size)
+		}
+		if start >= end {
+			continue
+		}
+
+		bf, err := backupFile(db, dest, fno, start, end)
+		if err != nil {
+			return nil, err
+		}
+		bm.Files = append(bm.Files, bf)
+	}
+
+	b, err := json.MarshalIndent(bm, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal backup manifest")
+	}
+	// the manifest is written last, a backup without it is incomplete
+	err = ioutil.WriteFile(filepath.Join(dest, backupManifestFile), b, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "write backup manifest")
+	}
+
+	return bm, nil
+}
+
+// committedWatermark gives the position up to which all records are completely written.
+// It is the end of backups and snapshots.
+// A read-only db does not know about writes in progress, the records of its
+// last data file are read up to the first one that is not complete.
+func committedWatermark(db *DB) (Ref, error) {
+	if db.writer != nil {
+		return committedPosition(db), nil
+	}
+
+	fnos, err := dataFiles(db)
+	if err != nil || len(fnos) == 0 {
+		return Ref{}, err
+	}
+	fno := fnos[len(fnos)-1]
+
+	dbf, err := getDataFile(db, fno)
+	if err != nil {
+		return Ref{}, err
+	}
+	size, err := dataFileSize(db, fno)
+	if err != nil {
+		return Ref{}, err
+	}
+
+	pos := dbf.start
+	var hb [headerSize]byte
+	for {
+		_, err = dbf.file.ReadAt(hb[:], int64(pos))
+		if err != nil {
+			break
+		}
+		h := (*header)(unsafe.Pointer(&hb[0]))
+		typ := string(h.Typ[:])
+		if !validTyp(typ) || db.codecFor(typ) == nil || h.Flags&^knownFlags != 0 ||
+			!h.fits(pos, db.MaxFileLength) || int64(pos)+int64(h.recordSize()) > size {
+			break
+		}
+		pos += uint32(h.recordSize())
+	}
+
+	return Ref{Fno: fno, Pos: pos}, nil
+}
+
+// backupFile copies [start, end) of data file fno to dest
+func backupFile(db *DB, dest string, fno uint32, start, end uint32) (BackupFile, error) {
+	bf := BackupFile{Fno: fno, Start: start, End: end}
+
+	f, err := getFile(db, fno)
+	if err != nil {
+		return bf, err
+	}
+
+	out, err := os.Create(filepath.Join(dest, fmt.Sprintf("%05d", fno)))
+	if err != nil {
+		return bf, errors.Wrap(err, "create backup file")
+	}
+	defer out.Close()
+
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, sum), io.NewSectionReader(f, int64(start), int64(end-start)))
+	if err != nil {
+		return bf, errors.Wrapf(err, "backup data file %05d", fno)
+	}
+	bf.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	return bf, out.Close()
+}
+
+// ReadBackup reads the manifest of the backup and verifies the checksums of its files
+func ReadBackup(dir string) (*BackupManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, backupManifestFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "read backup manifest")
+	}
+	bm := &BackupManifest{}
+	err = json.Unmarshal(b, bm)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse backup manifest")
+	}
+	if bm.Manifest == nil {
+		bm.Manifest = &manifest{}
+	}
+
+	for _, bf := range bm.Files {
+		sum := sha256.New()
+		err = copyBackupFile(dir, bf, sum)
+		if err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(sum.Sum(nil)) != bf.SHA256 {
+			return nil, errors.Wrapf(ErrChecksum, "backup file %05d", bf.Fno)
+		}
+	}
+
+	return bm, nil
+}
+
+// copyBackupFile copies the backup file to w, its length has to match the manifest
+func copyBackupFile(dir string, bf BackupFile, w io.Writer) error {
+	f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%05d", bf.Fno)))
+	if err != nil {
+		return errors.Wrap(err, "open backup file")
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return errors.Wrapf(err, "read backup file %05d", bf.Fno)
+	}
+	if n != int64(bf.End-bf.Start) {
+		return errors.Errorf("backup file %05d has %d bytes, not %d", bf.Fno, n, bf.End-bf.Start)
+	}
+	return nil
+}
+
+// Restore adds the backup to the db, which has to be opened read-write.
+//
+// A full backup is restored into an empty db, an incremental one
+// into a db restored up to its since.  The checksums are verified
+// before anything is written.
+func Restore(db *DB, dir string) (*BackupManifest, error) {
+	if db.writer == nil {
+		return nil, errors.New("opened read-only")
+	}
+
+	bm, err := ReadBackup(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.writePos != bm.Since {
+		return nil, errors.Errorf("backup starts at %s, the db is at %s", bm.Since, db.writePos)
+	}
+
+	err = xAdoptManifest(db, bm.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bf := range bm.Files {
+		dbf, err := xGetDataFile(db, bf.Fno)
+		if err != nil {
+			return nil, err
+		}
+
+		err = copyBackupFile(dir, bf, &fileWriter{file: dbf.file, pos: int64(bf.Start)})
+		if err != nil {
+			return nil, err
+		}
+
+		// the file header of the backup replaces ours
+		if bf.Start < fileHeaderSize {
+			err = readFileHeader(db, bf.Fno, dbf)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	db.writePos = bm.Watermark
+	return bm, writeWriterRef(db)
+}
+
+// fileWriter writes to the file sequentially from pos
+type fileWriter struct {
+	file *os.File
+	pos  int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.pos)
+	w.pos += int64(n)
+	return n, err
+}
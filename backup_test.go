@@ -0,0 +1,116 @@
+package bobstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Backup(t *testing.T) {
+	db, refs := openScanTestDB(t, 20)
+	defer closeScanTestDB(db)
+
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	full, err := db.Backup(filepath.Join(dir, "full"), Ref{})
+	if err != nil {
+		t.Fatalf("full backup: %v", err)
+	}
+
+	for i := 20; i < 30; i++ {
+		ref, err := db.Write([]byte(fmt.Sprintf("blob number %d", i)))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+
+	incr, err := db.Backup(filepath.Join(dir, "incr"), full.Watermark)
+	if err != nil {
+		t.Fatalf("incremental backup: %v", err)
+	}
+	if incr.Files[0].Fno != full.Watermark.Fno || incr.Files[0].Start != full.Watermark.Pos {
+		t.Errorf("incremental backup should start at %s, but: %+v", full.Watermark, incr.Files[0])
+	}
+
+	restored, err := OpenRW(filepath.Join(dir, "restored"))
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer restored.Close()
+
+	_, err = Restore(restored, filepath.Join(dir, "incr"))
+	if err == nil {
+		t.Errorf("incremental backup should not restore into an empty db")
+	}
+	for _, name := range []string{"full", "incr"} {
+		_, err = Restore(restored, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("restore %s: %v", name, err)
+		}
+	}
+
+	for i, ref := range refs {
+		b, err := restored.Read(ref)
+		if err != nil {
+			t.Fatalf("read restored %s: %v", ref, err)
+		}
+		if string(b) != fmt.Sprintf("blob number %d", i) {
+			t.Errorf("restored %s should be blob number %d, but: %q", ref, i, b)
+		}
+	}
+	fnos, _ := dataFiles(db)
+	for _, fno := range fnos {
+		b1, _ := ioutil.ReadFile(dataFileName(db, fno))
+		b2, _ := ioutil.ReadFile(dataFileName(restored, fno))
+		if !bytes.Equal(b1, b2) {
+			t.Errorf("data file %05d should be identical after restore", fno)
+		}
+	}
+
+	// damaged backup
+	name := filepath.Join(dir, "incr", fmt.Sprintf("%05d", incr.Files[0].Fno))
+	b, _ := ioutil.ReadFile(name)
+	b[len(b)-1] ^= 0xFF
+	ioutil.WriteFile(name, b, 0666)
+	_, err = ReadBackup(filepath.Join(dir, "incr"))
+	if errors.Cause(err) != ErrChecksum {
+		t.Errorf("damaged backup should fail with ErrChecksum, but: %v", err)
+	}
+}
+
+func Test_BackupReadOnly(t *testing.T) {
+	db, _ := openScanTestDB(t, 20)
+	defer closeScanTestDB(db)
+
+	ro, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+
+	// incomplete record at the end of the active file
+	pos := committedPosition(db)
+	_, err = getFile(db, pos.Fno)
+	if err != nil {
+		t.Fatalf("get file: %v", err)
+	}
+	db.files[pos.Fno].file.WriteAt([]byte("SNAP"), int64(pos.Pos))
+
+	watermark, err := committedWatermark(ro)
+	if err != nil {
+		t.Fatalf("watermark: %v", err)
+	}
+	if watermark != pos {
+		t.Errorf("read-only watermark should be %s, but: %s", pos, watermark)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -14,16 +15,55 @@ const writePosFile = "_writer"
 // DB is an opaque handle to an opened blob storage
 type DB struct {
 	MaxFileLength uint32
-	name          string
-	writer        *os.File
-	openflags     int
-	lock          sync.Mutex
-	writePos      Ref
-	files         map[uint16]*dbFile
+	// MaxFiles - writes fail with ErrStoreFull when all data files
+	// are in use.  Defaults to the MaxFiles of the last writer,
+	// which writes record in the manifest, or MaxNumberFilesV2.
+	MaxFiles uint32
+	// SoftLimit - OnSoftLimit is called when a write starts a new data file
+	// and this fraction of MaxFiles is in use.  Defaults to DefaultSoftLimit.
+	SoftLimit float64
+	// OnSoftLimit is called for warnings about the capacity, e.g. for alerting
+	OnSoftLimit func(Capacity)
+	// Checksums - write records with a CRC-32C checksum,
+	// it is verified on read.  Off by default.
+	Checksums bool
+	// KeyProvider gives the keys for reading encrypted blobs, see Encrypted
+	KeyProvider KeyProvider
+	// ExtendedRefs - Write and Cursor give extended refs with the store id,
+	// see Ref.  Off by default, plain refs keep their 14 character form.
+	ExtendedRefs bool
+
+	name      string
+	writer    *os.File
+	openflags int
+	lock      sync.Mutex
+	writePos  Ref
+	files     map[uint32]*dbFile
+	manifest  *manifest
+	storeID   uint16
+	ilock     sync.RWMutex
+	indexes   map[string]*index
+
+	// reserved records that are not completely written yet, in write order
+	pending []Ref
+
+	// when a read-only db last read the manifest for an unknown typ
+	manifestChecked time.Time
 }
 
 type dbFile struct {
 	file *os.File
+	// format version, see formatVersion
+	version uint32
+	// position of the first record
+	start uint32
+	// the file header was incomplete when a read-only db read it
+	pending bool
+
+	// offsets of the records before offsetsEnd, for reverse cursors
+	olock      sync.Mutex
+	offsets    []uint32
+	offsetsEnd uint32
 }
 
 // Open a DB for reading
@@ -31,9 +71,31 @@ func Open(name string) (*DB, error) {
 	db := &DB{
 		name:          name,
 		openflags:     os.O_RDONLY,
-		files:         make(map[uint16]*dbFile),
+		files:         make(map[uint32]*dbFile),
+		indexes:       make(map[string]*index),
 		MaxFileLength: MaxFileLength,
+		MaxFiles:      MaxNumberFilesV2,
+		SoftLimit:     DefaultSoftLimit,
 	}
+
+	err := readManifest(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = checkFormat(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = loadIndexes(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -42,8 +104,11 @@ func OpenRW(name string) (*DB, error) {
 	db := &DB{
 		name:          name,
 		openflags:     os.O_RDWR | os.O_CREATE,
-		files:         make(map[uint16]*dbFile),
+		files:         make(map[uint32]*dbFile),
+		indexes:       make(map[string]*index),
 		MaxFileLength: MaxFileLength,
+		MaxFiles:      MaxNumberFilesV2,
+		SoftLimit:     DefaultSoftLimit,
 	}
 
 	err := os.MkdirAll(name, 0777)
@@ -69,11 +134,38 @@ func OpenRW(name string) (*DB, error) {
 		return nil, err
 	}
 
+	err = readManifest(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = ensureStoreID(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = checkFormat(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = loadIndexes(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
 // Close an open DB
 func (db *DB) Close() (xerr error) {
+	// indexes record the write position, so they are closed first
+	xerr = closeIndexes(db)
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -1,11 +1,15 @@
 package bobstore
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"testing"
+	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 var testName string
@@ -67,8 +71,9 @@ func Test_Write(t *testing.T) {
 		t.Errorf("compress failed: %v", err)
 	}
 	t.Logf("compress result: %#v", ref)
-	if ref.Fno != 0 || ref.Pos != 0 {
-		t.Errorf("ref should be 00000:00000000: %s", ref)
+	// the first blob follows the file header
+	if ref.Fno != 0 || ref.Pos != fileHeaderSize {
+		t.Errorf("ref should be 00000:00000010: %s", ref)
 	}
 
 	if testDB.writePos.Pos == 0 {
@@ -134,3 +139,480 @@ func Test_Refs(t *testing.T) {
 		t.Errorf("error parsing ref: exp<>act\n%s\n%s", refStr, ref2.String())
 	}
 }
+
+func Test_WriteWithMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+
+	blob := "{\"hello\": \"world\"}"
+	meta := Meta{"content-type": "application/json", "source": "crm"}
+	ref, err := db.WriteWithMeta([]byte(blob), GZIPCodec(), meta)
+	if err != nil {
+		t.Fatalf("write with meta: %v", err)
+	}
+	ref2, err := db.Write([]byte(blob))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	b, err := db.Read(ref)
+	if err != nil || string(b) != blob {
+		t.Errorf("read %s: %q %v", ref, b, err)
+	}
+	b, err = db.Read(ref2)
+	if err != nil || string(b) != blob {
+		t.Errorf("read %s: %q %v", ref2, b, err)
+	}
+
+	c := db.Cursor(Ref{})
+	if !c.Next() {
+		t.Fatalf("cursor: no first blob %v", c.Error())
+	}
+	m, err := c.Meta()
+	if err != nil {
+		t.Errorf("cursor meta: %v", err)
+	}
+	if len(m) != 2 || m["content-type"] != "application/json" || m["source"] != "crm" {
+		t.Errorf("meta expected<>actual\n%v\n%v", meta, m)
+	}
+	if !c.Next() || c.Ref() != ref2 {
+		t.Fatalf("cursor: second blob should be %s: %s %v", ref2, c.Ref(), c.Error())
+	}
+	m, err = c.Meta()
+	if m != nil || err != nil {
+		t.Errorf("second blob should have no meta: %v %v", m, err)
+	}
+}
+
+func Test_JSONWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+
+	w := NewJSONWriter(db)
+	_, err = w.Write([]byte("{\"a\": 1"))
+	if _, ok := err.(*InvalidJSONError); !ok {
+		t.Errorf("expected *InvalidJSONError for invalid json, got: %v", err)
+	}
+
+	w.Canonicalize = true
+	ref, err := w.Write([]byte(" {\"b\": [1, 2.50, \"<x>\"],\n \"a\": {\"d\": null, \"c\": true}} "))
+	if err != nil {
+		t.Fatalf("json write: %v", err)
+	}
+	_, err = w.Write([]byte("{} {}"))
+	if _, ok := err.(*InvalidJSONError); !ok {
+		t.Errorf("expected *InvalidJSONError for trailing data, got: %v", err)
+	}
+
+	b, err := db.Read(ref)
+	if err != nil {
+		t.Fatalf("read %s: %v", ref, err)
+	}
+	expected := `{"a":{"c":true,"d":null},"b":[1,2.50,"<x>"]}`
+	if string(b) != expected {
+		t.Errorf("canonical expected<>actual\n%s\n%s", expected, b)
+	}
+
+	db.Write([]byte("not json"))
+	c := db.Cursor(Ref{})
+	if !c.Next() || !c.JSON() {
+		t.Errorf("first blob should be flagged as json")
+	}
+	if !c.Next() || c.JSON() {
+		t.Errorf("second blob should not be flagged as json")
+	}
+}
+
+func Test_IndexLiveWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+
+	ref1, _ := db.Write([]byte(`{"k": "a"}`))
+
+	// a record still being written, its header is not written yet
+	h := header{Compressed: 32}
+	f, pending, err := reserve(db, &h)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	f.WriteAt(make([]byte, h.recordSize()), int64(pending.Pos))
+	defer written(db, pending)
+
+	// completely written after it, before the index exists
+	ref2, _ := db.Write([]byte(`{"k": "b"}`))
+
+	err = db.AddIndex("$.k")
+	if err != nil {
+		t.Fatalf("add index with a write in progress: %v", err)
+	}
+	for value, ref := range map[string]Ref{"a": ref1, "b": ref2} {
+		refs, err := db.FindBy("$.k", value)
+		if err != nil || len(refs) != 1 || refs[0] != ref {
+			t.Errorf("FindBy %s expected [%s] actual %v %v", value, ref, refs, err)
+		}
+	}
+}
+
+func Test_Index(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+
+	ref1, _ := db.Write([]byte(`{"order": {"id": "A-1"}, "items": [{"sku": 42}]}`))
+	db.Write([]byte(`not json`))
+
+	// existing blobs are indexed when the index is added
+	err = db.AddIndex("$.order.id")
+	if err != nil {
+		t.Fatalf("add index: %v", err)
+	}
+	err = db.AddIndex("$.items[0].sku")
+	if err != nil {
+		t.Fatalf("add index: %v", err)
+	}
+
+	// new blobs on write
+	ref3, _ := db.Write([]byte(`{"order": {"id": "A-1"}, "items": [{"sku": 43}]}`))
+	ref4, _ := db.Write([]byte(`{"order": {"id": "B-2"}}`))
+
+	refs, err := db.FindBy("$.order.id", "A-1")
+	if err != nil || len(refs) != 2 || refs[0] != ref1 || refs[1] != ref3 {
+		t.Errorf("FindBy A-1 expected [%s %s] actual %v %v", ref1, ref3, refs, err)
+	}
+	refs, _ = db.FindBy("$.items[0].sku", "43")
+	if len(refs) != 1 || refs[0] != ref3 {
+		t.Errorf("FindBy sku 43 expected [%s] actual %v", ref3, refs)
+	}
+	db.Close()
+
+	// persisted and loaded on open
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+	refs, err = db.FindBy("$.order.id", "B-2")
+	if err != nil || len(refs) != 1 || refs[0] != ref4 {
+		t.Errorf("FindBy B-2 after reopen expected [%s] actual %v %v", ref4, refs, err)
+	}
+	err = db.RebuildIndex("$.order.id")
+	refs, _ = db.FindBy("$.order.id", "A-1")
+	if err != nil || len(refs) != 2 {
+		t.Errorf("FindBy A-1 after rebuild should find 2: %v %v", refs, err)
+	}
+
+	// a writer that died before recording the committed position
+	rw, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	ref5, _ := rw.Write([]byte(`{"order": {"id": "A-1"}}`))
+	crashed, _ := ioutil.ReadFile(indexFileName(rw, "$.order.id"))
+	rw.Close()
+	ioutil.WriteFile(indexFileName(rw, "$.order.id"), crashed, 0666)
+
+	ro, err := Open(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+	refs, _ = ro.FindBy("$.order.id", "A-1")
+	if len(refs) != 3 || refs[2] != ref5 {
+		t.Errorf("FindBy A-1 after crash expected every blob once, ending with %s, actual %v", ref5, refs)
+	}
+}
+
+func Test_CursorBlob(t *testing.T) {
+	db, refs := openScanTestDB(t, 20)
+	defer closeScanTestDB(db)
+
+	for _, readAhead := range []int{0, 64, 4096} {
+		c := db.Cursor(Ref{})
+		c.SetReadAhead(readAhead)
+		i := 0
+		for c.Next() {
+			if c.Ref() != refs[i] {
+				t.Errorf("read ahead %d: ref expected<>actual %s %s", readAhead, refs[i], c.Ref())
+			}
+			raw, err := c.Raw()
+			if err != nil || uint32(len(raw)) != c.Compressed() {
+				t.Errorf("read ahead %d: raw %s: %d bytes %v", readAhead, c.Ref(), len(raw), err)
+			}
+			b, err := c.Blob()
+			if err != nil || string(b) != fmt.Sprintf("blob number %d", i) {
+				t.Errorf("read ahead %d: blob %s: %q %v", readAhead, c.Ref(), b, err)
+			}
+			i++
+		}
+		if c.Error() != nil || i != len(refs) {
+			t.Errorf("read ahead %d: should have iterated %d times, but: %d %v", readAhead, len(refs), i, c.Error())
+		}
+	}
+}
+
+func Test_CursorRange(t *testing.T) {
+	db, refs := openScanTestDB(t, 30)
+	defer closeScanTestDB(db)
+
+	collect := func(c *Cursor) []Ref {
+		var result []Ref
+		for c.Next() {
+			result = append(result, c.Ref())
+		}
+		if c.Error() != nil {
+			t.Errorf("cursor error: %v", c.Error())
+		}
+		return result
+	}
+	check := func(name string, actual, expected []Ref) {
+		if len(actual) != len(expected) {
+			t.Errorf("%s: expected %d refs, but: %d %v", name, len(expected), len(actual), actual)
+			return
+		}
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Errorf("%s: ref %d expected<>actual %s %s", name, i, expected[i], actual[i])
+			}
+		}
+	}
+	reversed := func(refs []Ref) []Ref {
+		result := make([]Ref, len(refs))
+		for i, ref := range refs {
+			result[len(refs)-1-i] = ref
+		}
+		return result
+	}
+
+	check("range", collect(db.CursorRange(refs[3], refs[17])), refs[3:17])
+	check("range to end", collect(db.CursorRange(refs[25], Ref{})), refs[25:])
+	check("reverse", collect(db.ReverseCursor(Ref{}, Ref{})), reversed(refs))
+	check("reverse range", collect(db.ReverseCursor(refs[3], refs[17])), reversed(refs[3:17]))
+
+	wpos, _ := db.WritePosition()
+	check("reverse to write position", collect(db.ReverseCursor(refs[20], wpos)), reversed(refs[20:]))
+
+	c := db.ReverseCursor(Ref{}, Ref{})
+	if !c.Next() {
+		t.Fatalf("reverse cursor: no last blob %v", c.Error())
+	}
+	b, err := c.Blob()
+	if err != nil || string(b) != "blob number 29" {
+		t.Errorf("reverse cursor: last blob %q %v", b, err)
+	}
+
+	// the cached offsets of the last file grow with new writes
+	ref, _ := db.Write([]byte("blob number 30"))
+	refs = append(refs, ref)
+	check("reverse after write", collect(db.ReverseCursor(refs[20], Ref{})), reversed(refs[20:]))
+}
+
+func Test_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+	db.Checksums = true
+
+	var refs []Ref
+	for i := 0; i < 5; i++ {
+		ref, err := db.Write([]byte(fmt.Sprintf("blob number %d", i)))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+
+	// garbage in the header of blob 1 and the payload of blob 3
+	f, _ := os.OpenFile(filepath.Join(dir, "00000"), os.O_RDWR, 0666)
+	f.WriteAt([]byte("GARBAGE!\xff\xff\xff\xff\xff\xff\xff\x7f"), int64(refs[1].Pos))
+	f.WriteAt([]byte("X"), int64(refs[3].Pos+headerSize+2))
+	f.Close()
+
+	_, err = db.Read(refs[3])
+	if errors.Cause(err) != ErrChecksum {
+		t.Errorf("read of corrupted blob should fail with ErrChecksum, but: %v", err)
+	}
+
+	var skipped []string
+	c := db.Cursor(Ref{})
+	c.SetRecovery(func(fno uint32, start, end uint32) {
+		skipped = append(skipped, fmt.Sprintf("%05d:%x-%x", fno, start, end))
+	})
+	var found []Ref
+	for c.Next() {
+		found = append(found, c.Ref())
+	}
+	if c.Error() != nil {
+		t.Errorf("recovery cursor: %v", c.Error())
+	}
+
+	if len(found) != 3 || found[0] != refs[0] || found[1] != refs[2] || found[2] != refs[4] {
+		t.Errorf("recovery should have found %s %s %s, but: %v", refs[0], refs[2], refs[4], found)
+	}
+	expected := []string{
+		fmt.Sprintf("00000:%x-%x", refs[1].Pos, refs[2].Pos),
+		fmt.Sprintf("00000:%x-%x", refs[3].Pos, refs[4].Pos),
+	}
+	if len(skipped) != 2 || skipped[0] != expected[0] || skipped[1] != expected[1] {
+		t.Errorf("skipped expected<>actual\n%v\n%v", expected, skipped)
+	}
+}
+
+func Test_RecoverySizes(t *testing.T) {
+	// sizes that overflow 32 bit
+	for _, garbage := range []header{
+		{Typ: [4]byte{'S', 'N', 'A', 'P'}, Flags: flagCRC, Compressed: 0xFFFFFFFD},
+		{Typ: [4]byte{'S', 'N', 'A', 'P'}, MetaLength: 1, Compressed: 0xFFFFFFFF},
+	} {
+		db, refs := openScanTestDB(t, 5)
+
+		f, _ := os.OpenFile(dataFileName(db, refs[1].Fno), os.O_RDWR, 0666)
+		f.WriteAt((*headerBytes)(unsafe.Pointer(&garbage))[:], int64(refs[1].Pos))
+		f.Close()
+
+		_, err := db.Read(Ref{Fno: refs[1].Fno, Pos: refs[1].Pos})
+		if err == nil {
+			t.Errorf("%+v: read should fail", garbage)
+		}
+
+		c := db.Cursor(Ref{})
+		n := 0
+		for ; c.Next(); n++ {
+		}
+		if n != 1 || c.Error() == nil {
+			t.Errorf("%+v: cursor should stop with an error after 1 blob, but: %d %v", garbage, n, c.Error())
+		}
+
+		var skipped int
+		c = db.Cursor(Ref{})
+		c.SetRecovery(func(fno uint32, start, end uint32) { skipped++ })
+		n = 0
+		for ; c.Next(); n++ {
+			if _, err = c.Raw(); err != nil {
+				t.Errorf("%+v: raw %s: %v", garbage, c.Ref(), err)
+			}
+		}
+		if n != 4 || skipped != 1 || c.Error() != nil {
+			t.Errorf("%+v: recovery should skip the garbage header, but: %d blobs %d skipped %v", garbage, n, skipped, c.Error())
+		}
+
+		closeScanTestDB(db)
+	}
+}
+
+func Test_FileFormat(t *testing.T) {
+	db, refs := openScanTestDB(t, 3)
+	defer closeScanTestDB(db)
+
+	content, err := ioutil.ReadFile(filepath.Join(db.name, "00000"))
+	if err != nil {
+		t.Fatalf("read data file: %v", err)
+	}
+	if string(content[:8]) != fileMagic || content[8] != formatVersion {
+		t.Errorf("data file should start with magic and version: %q", content[:16])
+	}
+
+	// a legacy file starts directly with the first blob
+	legacy, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(legacy)
+	ioutil.WriteFile(filepath.Join(legacy, "00000"), content[fileHeaderSize:], 0666)
+
+	ldb, err := Open(legacy)
+	if err != nil {
+		t.Fatalf("open legacy db: %v", err)
+	}
+	c := ldb.Cursor(Ref{})
+	i := 0
+	for c.Next() {
+		expected := Ref{Fno: 0, Pos: refs[i].Pos - fileHeaderSize}
+		b, err := ldb.Read(c.Ref())
+		if c.Ref() != expected || err != nil || string(b) != fmt.Sprintf("blob number %d", i) {
+			t.Errorf("legacy blob %d: %s %q %v", i, c.Ref(), b, err)
+		}
+		i++
+	}
+	if i != len(refs) || c.Error() != nil {
+		t.Errorf("legacy cursor should have iterated %d times, but: %d %v", len(refs), i, c.Error())
+	}
+	ldb.Close()
+
+	// newer versions are refused
+	content[8] = formatVersion + 1
+	ioutil.WriteFile(filepath.Join(legacy, "00000"), content, 0666)
+	_, err = Open(legacy)
+	if _, ok := err.(*VersionError); !ok {
+		t.Errorf("open should have failed with a *VersionError, but: %v", err)
+	}
+
+	// also if it is not the newest file
+	ioutil.WriteFile(filepath.Join(legacy, "00001"), content[fileHeaderSize:], 0666)
+	_, err = Open(legacy)
+	if _, ok := err.(*VersionError); !ok {
+		t.Errorf("open with an older file of a newer version should have failed with a *VersionError, but: %v", err)
+	}
+
+	// a file the writer has just created, without file header yet
+	ro, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+	ioutil.WriteFile(filepath.Join(db.name, "00001"), nil, 0666)
+	dbf, err := getDataFile(ro, 1)
+	if err != nil || !dbf.pending || dbf.start != fileHeaderSize {
+		t.Fatalf("a file without header should have no records yet: %+v %v", dbf, err)
+	}
+	ioutil.WriteFile(filepath.Join(db.name, "00001"), content[:fileHeaderSize-1], 0666)
+	if dbf, err = getDataFile(ro, 1); err != nil || !dbf.pending {
+		t.Errorf("a file with an incomplete header should have no records yet: %+v %v", dbf, err)
+	}
+	content[8] = formatVersion
+	ioutil.WriteFile(filepath.Join(db.name, "00001"), content[:fileHeaderSize], 0666)
+	if dbf, err = getDataFile(ro, 1); err != nil || dbf.pending || dbf.version != formatVersion {
+		t.Errorf("the file header should be read again: %+v %v", dbf, err)
+	}
+}
@@ -0,0 +1,76 @@
+package bobstore
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrStoreFull is returned by writes when all MaxFiles data files are in use
+var ErrStoreFull = errors.New("store full")
+
+// DefaultSoftLimit is the default of DB.SoftLimit
+const DefaultSoftLimit = 0.9
+
+// Capacity reports the used and remaining data files and bytes of a db.
+// Data files are counted with their maximum length MaxFileLength.
+type Capacity struct {
+	MaxFiles       uint32
+	UsedFiles      uint64
+	RemainingFiles uint64
+	UsedBytes      uint64
+	RemainingBytes uint64
+}
+
+// Used is the used fraction of the capacity
+func (c Capacity) Used() float64 {
+	return float64(c.UsedFiles) / float64(c.MaxFiles)
+}
+
+// Capacity gives the used and remaining capacity up to the committed position
+func (db *DB) Capacity() (Capacity, error) {
+	pos, err := committedWatermark(db)
+	if err != nil {
+		return Capacity{}, err
+	}
+	return capacityAt(db, pos), nil
+}
+
+// capacityAt gives the capacity with the write position at pos
+func capacityAt(db *DB, pos Ref) Capacity {
+	c := Capacity{MaxFiles: db.MaxFiles}
+	if !pos.IsZero() {
+		c.UsedFiles = uint64(pos.Fno) + 1
+		c.UsedBytes = uint64(pos.Fno)*uint64(db.MaxFileLength) + uint64(pos.Pos)
+	}
+
+	total := uint64(db.MaxFiles) * uint64(db.MaxFileLength)
+	if c.UsedFiles < uint64(db.MaxFiles) {
+		c.RemainingFiles = uint64(db.MaxFiles) - c.UsedFiles
+	}
+	if c.UsedBytes < total {
+		c.RemainingBytes = total - c.UsedBytes
+	}
+	return c
+}
+
+// xRecordMaxFiles records MaxFiles in the manifest, so readers
+// report the capacity against it.  x means mutex is acquired.
+func xRecordMaxFiles(db *DB) error {
+	recorded := db.manifest.MaxFiles
+	if recorded == 0 {
+		recorded = MaxNumberFilesV2
+	}
+	if recorded == db.MaxFiles {
+		return nil
+	}
+
+	db.manifest.MaxFiles = db.MaxFiles
+	if db.MaxFiles == MaxNumberFilesV2 {
+		db.manifest.MaxFiles = 0
+	}
+	return xWriteManifest(db)
+}
+
+// overSoftLimit is true if the capacity at pos is beyond the soft limit
+func overSoftLimit(db *DB, pos Ref) bool {
+	return db.OnSoftLimit != nil && capacityAt(db, pos).Used() >= db.SoftLimit
+}
@@ -0,0 +1,94 @@
+package bobstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Capacity(t *testing.T) {
+	db, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(db)
+
+	c, err := db.Capacity()
+	if err != nil || c.UsedFiles != 0 || c.RemainingFiles != MaxNumberFilesV2 {
+		t.Errorf("empty db should have all files remaining: %+v %v", c, err)
+	}
+
+	db.MaxFiles = 10
+	db.SoftLimit = 0.5
+	var warnings []Capacity
+	db.OnSoftLimit = func(c Capacity) {
+		// the db can be used from the callback
+		if _, err := db.Capacity(); err != nil {
+			t.Errorf("capacity in callback: %v", err)
+		}
+		warnings = append(warnings, c)
+	}
+
+	n := 0
+	for ; n < 1000; n++ {
+		_, err = db.Write([]byte(fmt.Sprintf("blob number %d", n)))
+		if err != nil {
+			break
+		}
+	}
+	if errors.Cause(err) != ErrStoreFull {
+		t.Fatalf("writes should fail with ErrStoreFull, but after %d: %v", n, err)
+	}
+
+	if len(warnings) != 6 || warnings[0].UsedFiles != 5 || warnings[5].RemainingFiles != 0 {
+		t.Errorf("a warning should be given for each file from the 5th on, but: %+v", warnings)
+	}
+
+	c, err = db.Capacity()
+	if err != nil || c.UsedFiles != 10 || c.RemainingFiles != 0 || c.UsedBytes == 0 ||
+		c.UsedBytes+c.RemainingBytes != 10*256 {
+		t.Errorf("full db should have no files remaining: %+v %v", c, err)
+	}
+
+	ro, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+	// MaxFiles is recorded in the manifest
+	ro.MaxFileLength = 256
+	rc, err := ro.Capacity()
+	if err != nil || rc != c {
+		t.Errorf("read-only db should report the same capacity %+v, but: %+v %v", c, rc, err)
+	}
+}
+
+func Test_SoftLimitFailedWrite(t *testing.T) {
+	db, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(db)
+
+	db.MaxFiles = 4
+	db.SoftLimit = 0.5
+	var warnings []Capacity
+	db.OnSoftLimit = func(c Capacity) {
+		warnings = append(warnings, c)
+	}
+
+	// the second data file can not be created
+	err := os.Mkdir(filepath.Join(db.name, "00001"), 0777)
+	if err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = db.Write([]byte(fmt.Sprintf("blob number %d", i)))
+	}
+	if err == nil || len(warnings) != 0 {
+		t.Fatalf("a failed write should give no warning, but: %+v %v", warnings, err)
+	}
+
+	os.Remove(filepath.Join(db.name, "00001"))
+	_, err = db.Write([]byte("in the second file"))
+	if err != nil || len(warnings) != 1 || warnings[0].UsedFiles != 2 {
+		t.Errorf("the write to the second file should give a warning, but: %+v %v", warnings, err)
+	}
+}
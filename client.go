@@ -0,0 +1,262 @@
+package bobstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Store is implemented by a local *DB and by a *Client for a remote db
+type Store interface {
+	Read(ref Ref) ([]byte, error)
+	Write(b []byte) (Ref, error)
+	WriteWithCodec(b []byte, codec *Codec) (Ref, error)
+	Cursor(next Ref) *Cursor
+	WritePosition() (Ref, error)
+}
+
+var _ Store = (*DB)(nil)
+var _ Store = (*Client)(nil)
+
+// clientPageSize is the number of blobs a remote cursor requests at once
+const clientPageSize = 1000
+
+// Client accesses a db served by NewHandler over http.
+//
+// Its http.Client pools connections, it is safe to use
+// from multiple goroutines.
+type Client struct {
+	// Retries is the number of retries of reads that failed
+	// with a network error or a server error.  Writes are not retried.
+	Retries int
+	// RetryWait is the wait before the first retry, it doubles with every retry
+	RetryWait time.Duration
+
+	url      string
+	client   *http.Client
+	pageSize int
+}
+
+// NewClient returns a Client for the server at url, e.g. http://localhost:8080
+func NewClient(url string) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 16
+
+	return &Client{
+		Retries:   3,
+		RetryWait: 100 * time.Millisecond,
+		url:       strings.TrimSuffix(url, "/"),
+		client:    &http.Client{Transport: transport},
+		pageSize:  clientPageSize,
+	}
+}
+
+// statusError gives an error for a response that is not ok.
+// 404 is an invalid ref like for a local db, 507 a full store.
+func statusError(resp *http.Response, what string) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(b))
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.Wrapf(ErrInvalidRef, "%s: %s", what, msg)
+	}
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return errors.Wrapf(ErrStoreFull, "%s: %s", what, msg)
+	}
+	return errors.Errorf("%s: %s: %s", what, resp.Status, msg)
+}
+
+// get retries the request on network and server errors.
+// The caller closes the body of the ok response.
+func (cl *Client) get(path string, what string) (*http.Response, error) {
+	wait := cl.RetryWait
+	for i := 0; ; i++ {
+		resp, err := cl.client.Get(cl.url + path)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		if err == nil {
+			err = statusError(resp, what)
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				return nil, err
+			}
+		}
+		if i >= cl.Retries {
+			return nil, errors.Wrapf(err, "%s failed after %d tries", what, i+1)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// drain reads the rest of the body so the connection can be reused
+func drain(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
+
+// Read the blob at ref
+func (cl *Client) Read(ref Ref) ([]byte, error) {
+	resp, err := cl.get("/blobs/"+ref.String(), "read "+ref.String())
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp.Body)
+
+	// gzip passed through by the server is decompressed by the transport
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read failed for %s", ref)
+	}
+	return b, nil
+}
+
+// Write the blob, the server uses its default SnappyCodec()
+func (cl *Client) Write(b []byte) (Ref, error) {
+	return cl.post("/blobs", b)
+}
+
+// WriteWithCodec writes the blob with the codec, which must be known to the server.
+// Codecs that choose or encrypt on the client side can not be used.
+func (cl *Client) WriteWithCodec(b []byte, codec *Codec) (Ref, error) {
+	if codec.choose != nil || codec.flags != 0 {
+		return Ref{}, errors.Errorf("codec %s can not be used with a remote db", codec.typ)
+	}
+	return cl.post("/blobs?codec="+url.QueryEscape(codec.typ), b)
+}
+
+func (cl *Client) post(path string, b []byte) (Ref, error) {
+	resp, err := cl.client.Post(cl.url+path, "application/octet-stream", bytes.NewReader(b))
+	if err != nil {
+		return Ref{}, errors.Wrap(err, "write")
+	}
+	defer drain(resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		return Ref{}, statusError(resp, "write")
+	}
+
+	return readRefBody(resp.Body)
+}
+
+func readRefBody(body io.Reader) (Ref, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return Ref{}, err
+	}
+	return ParseRef(strings.TrimSpace(string(b)))
+}
+
+// WritePosition gives the write position of the server,
+// only implemented if it opened the db read-write
+func (cl *Client) WritePosition() (Ref, error) {
+	resp, err := cl.get("/position", "write position")
+	if err != nil {
+		return Ref{}, err
+	}
+	defer drain(resp.Body)
+
+	return readRefBody(resp.Body)
+}
+
+// Cursor iterates over the remote db.
+// next is the initial ref, null value means beginning of DB.
+//
+// The blobs are requested in pages, Raw() is not available.
+func (cl *Client) Cursor(next Ref) *Cursor {
+	return &Cursor{next: next, from: next, remote: &remoteCursor{client: cl}}
+}
+
+// remoteCursor reads the NDJSON stream of GET /cursor
+type remoteCursor struct {
+	client *Client
+	body   io.ReadCloser
+	dec    *json.Decoder
+	done   bool
+	line   cursorLine
+}
+
+func (r *remoteCursor) next(c *Cursor) bool {
+	for {
+		if r.dec == nil {
+			if r.done {
+				return false
+			}
+			err := r.request(c)
+			if err != nil {
+				c.err = err
+				return false
+			}
+		}
+
+		r.line = cursorLine{}
+		err := r.dec.Decode(&r.line)
+		if err == io.EOF {
+			// no next line: the last page
+			r.close()
+			r.done = true
+			continue
+		}
+		if err != nil {
+			r.close()
+			c.err = errors.Wrapf(err, "remote cursor after %s", c.ref)
+			return false
+		}
+
+		switch {
+		case r.line.Error != "":
+			r.close()
+			c.err = errors.New(r.line.Error)
+			return false
+		case r.line.Next != nil:
+			r.close()
+			c.next = *r.line.Next
+			continue
+		}
+
+		c.ref = r.line.Ref
+		c.h = header{Length: r.line.Length, Compressed: r.line.Compressed}
+		copy(c.h.Typ[:], r.line.Typ)
+		if r.line.JSON {
+			c.h.Flags |= flagJSON
+		}
+		if r.line.Encrypted {
+			c.h.Flags |= flagEncrypted
+		}
+		return true
+	}
+}
+
+// request the page starting at c.next
+func (r *remoteCursor) request(c *Cursor) error {
+	q := url.Values{}
+	q.Set("from", c.next.String())
+	if !c.to.IsZero() {
+		q.Set("to", c.to.String())
+	}
+	q.Set("limit", fmt.Sprint(r.client.pageSize))
+
+	resp, err := r.client.get("/cursor?"+q.Encode(), "cursor from "+c.next.String())
+	if err != nil {
+		return err
+	}
+	r.body = resp.Body
+	r.dec = json.NewDecoder(resp.Body)
+	return nil
+}
+
+func (r *remoteCursor) close() {
+	if r.body != nil {
+		drain(r.body)
+	}
+	r.body = nil
+	r.dec = nil
+}
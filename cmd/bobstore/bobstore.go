@@ -6,34 +6,77 @@ import "log"
 import "github.com/random-j-farmer/bobstore"
 import "encoding/json"
 import "crypto/sha1"
+import "sort"
+import "net/http"
+import "time"
+
+// readAhead is the read-ahead buffer size for full scans
+const readAhead = 1024 * 1024
 
 func main() {
 	if len(os.Args) == 1 {
 		log.Fatal(`Usage:
-bobstore ls DB
-bobstore show DB 00000:00000000
-bobstore gzip SRCDB DSTDB
-bobstore snap SRCDB DSTDB
-bobstore json SRCDB
+bobstore ls DB...
+bobstore show DB... [PREFIX/]00000:00000000
+bobstore gzip SRCDB DSTDB [--refmap FILE]
+bobstore snap SRCDB DSTDB [--refmap FILE]
+bobstore json SRCDB... [--at WATERMARK...]
+bobstore index DB '$.json.path'
+bobstore find DB '$.json.path' VALUE
+bobstore rekey SRCDB DSTDB NEWKEYFILE [--refmap FILE]
+bobstore serve DB [--listen :8080] [--writable]
+bobstore follow DB --primary http://primary:8080
+bobstore backup DB DEST [--since 00000:00000000]
+bobstore restore DB BACKUP...
+bobstore migrate-cold DB COLDDIR --older-than 720h
+bobstore capacity DB
+
+Encrypted DBs are read with the keys from the key file in $BOBSTORE_KEYS.
+Copies write the mapping of old to new refs to the --refmap file.
+index persists an index in the DB, find uses it.
+json exports a snapshot, its watermark is logged, --at repeats the export.
+Across several DBs there is a PREFIX/WATERMARK per DB.
+A relative COLDDIR is relative to the DB directory, each run may use another one.
+Writes log a warning when the DB is close to full.
+serve is read-only, --writable allows POST /blobs and followers.
+ls, show and json read across several DBs, the refs are qualified
+with the directory name of their DB as PREFIX.
 `)
 	}
 
+	if paths := multiPaths(os.Args[1], os.Args[2:]); len(paths) > 1 {
+		multiMain(os.Args[1], paths, os.Args[2+len(paths):])
+		return
+	}
+
 	dbName := os.Args[2]
-	db, err := bobstore.Open(dbName)
+	open := bobstore.Open
+	if os.Args[1] == "follow" || os.Args[1] == "restore" ||
+		os.Args[1] == "migrate-cold" || os.Args[1] == "index" {
+		// these write: the follower, restore, the manifest, the index file
+		open = bobstore.OpenRW
+	}
+	listen, writable := serveOptions(os.Args[3:])
+	if os.Args[1] == "serve" && writable {
+		// POST /blobs, replication needs the committed position of the writer
+		open = bobstore.OpenRW
+	}
+	db, err := open(dbName)
 	if err != nil {
 		log.Fatalf("can not open bobs db: %v", err)
 	}
+	db.OnSoftLimit = warnSoftLimit
+
+	if keyFile := os.Getenv("BOBSTORE_KEYS"); keyFile != "" {
+		db.KeyProvider, err = bobstore.ReadKeyFile(keyFile)
+		if err != nil {
+			log.Fatalf("can not read keys: %v", err)
+		}
+	}
 
 	cmd := os.Args[1]
 	if cmd == "ls" {
-		cursor := db.Cursor(bobstore.Ref{})
-		for cursor.Next() {
-			ratio := float64(cursor.Compressed()) / float64(cursor.Length())
-			fmt.Printf("%s %s %d/%d %g\n", cursor.Ref(), cursor.Typ(), cursor.Compressed(), cursor.Length(), ratio)
-		}
-		if cursor.Error() != nil {
-			log.Fatalf("cursor.next: %v", cursor.Error())
-		}
+		listBlobs(db.Cursor(bobstore.Ref{}))
 	} else if cmd == "show" {
 		var ref bobstore.Ref
 		ref, err = bobstore.ParseRef(os.Args[3])
@@ -49,72 +92,428 @@ bobstore json SRCDB
 
 		fmt.Printf("%s", blob)
 	} else if cmd == "gzip" {
-		err = copyDB(db, os.Args[3], "GZIP")
+		err = copyDB(db, os.Args[3], "GZIP", nil, false, refMapFile(os.Args[4:]))
 		if err != nil {
 			log.Fatalf("copy error: %v", err)
 		}
 	} else if cmd == "snap" {
-		err = copyDB(db, os.Args[3], "SNAP")
+		err = copyDB(db, os.Args[3], "SNAP", nil, false, refMapFile(os.Args[4:]))
 		if err != nil {
 			log.Fatalf("copy error: %v", err)
 		}
 	} else if cmd == "json" {
-		err = exportJSON(db)
+		var snap *bobstore.Snapshot
+		if len(os.Args) > 4 && os.Args[3] == "--at" {
+			var at bobstore.Ref
+			at, err = bobstore.ParseRef(os.Args[4])
+			if err != nil {
+				log.Fatalf("can not parse ref: %s", os.Args[4])
+			}
+			snap, err = db.SnapshotAt(at)
+		} else {
+			snap, err = db.Snapshot()
+		}
+		if err != nil {
+			log.Fatalf("snapshot error: %v", err)
+		}
+		log.Printf("snapshot at %s", snap.Watermark())
+
+		err = exportJSON(snap.Cursor(bobstore.Ref{}))
 		if err != nil {
 			log.Fatalf("json error: %v", err)
 		}
+	} else if cmd == "index" {
+		err = db.AddIndex(os.Args[3])
+		if err != nil {
+			log.Fatalf("can not index %s: %v", os.Args[3], err)
+		}
+		err = db.Close()
+		if err != nil {
+			log.Fatalf("close error: %v", err)
+		}
+	} else if cmd == "find" {
+		// persisted indexes are loaded on open and catch up from their watermark
+		if !db.HasIndex(os.Args[3]) {
+			log.Printf("no index for %s, scanning the db; bobstore index persists one", os.Args[3])
+			err = db.AddIndex(os.Args[3])
+			if err != nil {
+				log.Fatalf("can not index %s: %v", os.Args[3], err)
+			}
+		}
+
+		var refs []bobstore.Ref
+		refs, err = db.FindBy(os.Args[3], os.Args[4])
+		if err != nil {
+			log.Fatalf("find error: %v", err)
+		}
+		for _, ref := range refs {
+			fmt.Printf("%s\n", ref)
+		}
+	} else if cmd == "rekey" {
+		var keys *bobstore.StaticKeys
+		keys, err = bobstore.ReadKeyFile(os.Args[4])
+		if err != nil {
+			log.Fatalf("can not read keys: %v", err)
+		}
+
+		// keep the codec of every blob
+		err = copyDB(db, os.Args[3], "", keys, true, refMapFile(os.Args[5:]))
+		if err != nil {
+			log.Fatalf("rekey error: %v", err)
+		}
+	} else if cmd == "serve" {
+		log.Printf("serving %s on %s, writable: %v", dbName, listen, writable)
+		err = http.ListenAndServe(listen, bobstore.NewHandler(db))
+		db.Close()
+		log.Fatalf("serve error: %v", err)
+	} else if cmd == "follow" {
+		if len(os.Args) < 5 || os.Args[3] != "--primary" {
+			log.Fatalf("follow needs --primary URL")
+		}
+
+		var fl *bobstore.Follower
+		fl, err = bobstore.NewFollower(db, bobstore.NewClient(os.Args[4]))
+		if err != nil {
+			log.Fatalf("follow error: %v", err)
+		}
+		var last bobstore.Ref
+		for {
+			err = fl.Sync()
+			if err != nil {
+				log.Printf("sync error: %v", err)
+			} else if fl.Applied() != last {
+				last = fl.Applied()
+				log.Printf("applied %s, lag %d bytes", last, fl.Lag())
+			}
+			time.Sleep(fl.PollInterval)
+		}
+	} else if cmd == "backup" {
+		var since bobstore.Ref
+		if len(os.Args) > 5 && os.Args[4] == "--since" {
+			since, err = bobstore.ParseRef(os.Args[5])
+			if err != nil {
+				log.Fatalf("can not parse ref: %s", os.Args[5])
+			}
+		}
+
+		var bm *bobstore.BackupManifest
+		bm, err = db.Backup(os.Args[3], since)
+		if err != nil {
+			log.Fatalf("backup error: %v", err)
+		}
+		// the since of the next backup
+		fmt.Printf("watermark %s\n", bm.Watermark)
+	} else if cmd == "restore" {
+		for _, dir := range os.Args[3:] {
+			var bm *bobstore.BackupManifest
+			bm, err = bobstore.Restore(db, dir)
+			if err != nil {
+				db.Close()
+				log.Fatalf("restore %s: %v", dir, err)
+			}
+			fmt.Printf("restored %s up to %s\n", dir, bm.Watermark)
+		}
+		err = db.Close()
+		if err != nil {
+			log.Fatalf("close error: %v", err)
+		}
+	} else if cmd == "migrate-cold" {
+		if len(os.Args) < 6 || os.Args[4] != "--older-than" {
+			log.Fatalf("migrate-cold needs --older-than DURATION")
+		}
+		var olderThan time.Duration
+		olderThan, err = time.ParseDuration(os.Args[5])
+		if err != nil {
+			log.Fatalf("can not parse duration: %s", os.Args[5])
+		}
+
+		var moved []uint32
+		moved, err = db.MigrateCold(os.Args[3], olderThan)
+		for _, fno := range moved {
+			fmt.Printf("moved %05d\n", fno)
+		}
+		if err != nil {
+			db.Close()
+			log.Fatalf("migrate-cold error: %v", err)
+		}
+		err = db.Close()
+		if err != nil {
+			log.Fatalf("close error: %v", err)
+		}
+	} else if cmd == "capacity" {
+		var c bobstore.Capacity
+		c, err = db.Capacity()
+		if err != nil {
+			log.Fatalf("capacity error: %v", err)
+		}
+		fmt.Printf("files: %d used, %d remaining of %d\n", c.UsedFiles, c.RemainingFiles, c.MaxFiles)
+		fmt.Printf("bytes: %d used, %d remaining\n", c.UsedBytes, c.RemainingBytes)
 	} else {
 		log.Fatalf("unknown command %s", cmd)
 	}
 }
 
-func copyDB(db *bobstore.DB, dst, codec string) error {
+// warnSoftLimit logs that the db is close to full
+func warnSoftLimit(c bobstore.Capacity) {
+	log.Printf("warning: %.1f%% of the db is used, %d files remaining", 100*c.Used(), c.RemainingFiles)
+}
+
+// multiPaths gives the DB paths of ls, show and json, nil for other commands
+func multiPaths(cmd string, args []string) []string {
+	switch cmd {
+	case "ls":
+		return args
+	case "show":
+		if len(args) > 1 {
+			return args[:len(args)-1]
+		}
+	case "json":
+		for i, arg := range args {
+			if arg == "--at" {
+				return args[:i]
+			}
+		}
+		return args
+	}
+	return nil
+}
+
+// multiMain runs ls, show or json across several DBs
+func multiMain(cmd string, paths []string, args []string) {
+	m, err := bobstore.OpenMulti(paths...)
+	if err != nil {
+		log.Fatalf("can not open bobs dbs: %v", err)
+	}
+	defer m.Close()
+
+	if keyFile := os.Getenv("BOBSTORE_KEYS"); keyFile != "" {
+		keys, err := bobstore.ReadKeyFile(keyFile)
+		if err != nil {
+			log.Fatalf("can not read keys: %v", err)
+		}
+		for _, db := range m.DBs() {
+			db.KeyProvider = keys
+		}
+	}
+
+	switch cmd {
+	case "ls":
+		listBlobs(m.Cursor(bobstore.QRef{}))
+	case "show":
+		ref, err := bobstore.ParseQRef(args[0])
+		if err != nil {
+			log.Fatalf("can not parse ref: %s", args[0])
+		}
+
+		blob, err := m.Read(ref)
+		if err != nil {
+			log.Fatalf("can not read ref %s: %v", ref, err)
+		}
+
+		fmt.Printf("%s", blob)
+	case "json":
+		var snap *bobstore.MultiSnapshot
+		if len(args) > 1 && args[0] == "--at" {
+			var at []bobstore.QRef
+			for _, arg := range args[1:] {
+				q, err := bobstore.ParseQRef(arg)
+				if err != nil {
+					log.Fatalf("can not parse ref: %s", arg)
+				}
+				at = append(at, q)
+			}
+			snap, err = m.SnapshotAt(at...)
+		} else {
+			snap, err = m.Snapshot()
+		}
+		if err != nil {
+			log.Fatalf("snapshot error: %v", err)
+		}
+		for _, q := range snap.Watermarks() {
+			log.Printf("snapshot at %s", q)
+		}
+
+		err = exportJSON(snap.Cursor(bobstore.QRef{}))
+		if err != nil {
+			log.Fatalf("json error: %v", err)
+		}
+	}
+}
+
+// listBlobs prints a line for every blob of the cursor
+func listBlobs(cursor *bobstore.Cursor) {
+	for cursor.Next() {
+		ratio := float64(cursor.Compressed()) / float64(cursor.Length())
+		meta, err := cursor.Meta()
+		if err != nil {
+			log.Fatalf("cursor.meta: %v", err)
+		}
+		fmt.Printf("%s %s %d/%d %g%s\n", cursor.QRef(), cursor.Typ(), cursor.Compressed(), cursor.Length(), ratio, formatMeta(meta))
+	}
+	if cursor.Error() != nil {
+		log.Fatalf("cursor.next: %v", cursor.Error())
+	}
+}
+
+// serveOptions gives the --listen address and the --writable flag of serve
+func serveOptions(args []string) (listen string, writable bool) {
+	listen = ":8080"
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--listen" && i+1 < len(args):
+			listen = args[i+1]
+			i++
+		case args[i] == "--writable":
+			writable = true
+		}
+	}
+	return
+}
+
+// refMapFile gives the file name of the --refmap option, "" if none
+func refMapFile(args []string) string {
+	if len(args) > 1 && args[0] == "--refmap" {
+		return args[1]
+	}
+	return ""
+}
+
+// copyDB copies all blobs to dst with the codec, "" means the codec of the blob.
+// If keys is not nil, the copies are encrypted.  If refMap is not "",
+// the mapping of old to new refs is written to this file.
+// If strict, the copy stops at the first blob that can not be copied,
+// otherwise the error is logged.
+func copyDB(db *bobstore.DB, dst, codec string, keys bobstore.KeyProvider, strict bool, refMap string) error {
 	dstDB, err := bobstore.OpenRW(dst)
 	defer dstDB.Close()
 
 	if err != nil {
 		log.Fatalf("bobstore.OpenRW %s: %v", dst, err)
 	}
+	dstDB.OnSoftLimit = warnSoftLimit
+
+	var refs *bobstore.RefMapWriter
+	var mapFile *os.File
+	if refMap != "" {
+		mapFile, err = os.Create(refMap)
+		if err != nil {
+			return err
+		}
+		// closed again below for the error
+		defer mapFile.Close()
+
+		refs = bobstore.NewRefMapWriter(mapFile)
+	}
 
 	cursor := db.Cursor(bobstore.Ref{})
-	gzCodec := bobstore.CodecFor(codec)
+	cursor.SetReadAhead(readAhead)
 	for cursor.Next() {
 		fmt.Printf("%s\n", cursor.Ref())
-		b, err := db.Read(cursor.Ref())
+		gzCodec := bobstore.CodecFor(codec)
+		if codec == "" {
+			// pipelines may only be recorded in the manifest
+			gzCodec = db.CodecFor(cursor.Typ())
+		}
+		if gzCodec == nil {
+			if strict {
+				return fmt.Errorf("unknown codec %s for %s", cursor.Typ(), cursor.Ref())
+			}
+			log.Printf("unknown codec %s for %s", cursor.Typ(), cursor.Ref())
+			continue
+		}
+		if keys != nil {
+			gzCodec = bobstore.Encrypted(gzCodec, keys)
+		}
+
+		// a blob that could not be read is not copied
+		b, err := cursor.Blob()
 		if err != nil {
+			if strict {
+				return fmt.Errorf("error reading %s: %v", cursor.Ref(), err)
+			}
 			log.Printf("error reading %s: %v", cursor.Ref(), err)
+			continue
+		}
+
+		meta, err := cursor.Meta()
+		if err != nil {
+			if strict {
+				return fmt.Errorf("error reading meta %s: %v", cursor.Ref(), err)
+			}
+			log.Printf("error reading meta %s: %v", cursor.Ref(), err)
+			continue
 		}
 
-		ref2, err := dstDB.WriteWithCodec(b, gzCodec)
+		var ref2 bobstore.Ref
+		if cursor.JSON() {
+			// the copy stays marked as json
+			w := bobstore.NewJSONWriter(dstDB)
+			w.Codec = gzCodec
+			ref2, err = w.WriteWithMeta(b, meta)
+		} else {
+			ref2, err = dstDB.WriteWithMeta(b, gzCodec, meta)
+		}
 		if err != nil {
+			if strict {
+				return fmt.Errorf("error writing %s: %v", cursor.Ref(), err)
+			}
 			log.Printf("error writing %s: %v", cursor.Ref(), err)
+			continue
 		}
 		fmt.Printf("new ref: %s\n", ref2)
+
+		if refs != nil {
+			err = refs.Add(cursor.Ref(), ref2)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	if cursor.Error() != nil {
-		log.Fatalf("cursor.next: %v", cursor.Error())
+		return fmt.Errorf("cursor.next: %v", cursor.Error())
+	}
+
+	if refs != nil {
+		err = refs.Flush()
+		if err != nil {
+			return fmt.Errorf("write %s: %v", refMap, err)
+		}
+		err = mapFile.Close()
+		if err != nil {
+			return fmt.Errorf("close %s: %v", refMap, err)
+		}
 	}
 
 	return nil
 }
 
-func exportJSON(db *bobstore.DB) error {
-	cursor := db.Cursor(bobstore.Ref{})
+func exportJSON(cursor *bobstore.Cursor) error {
+	cursor.SetReadAhead(readAhead)
 	for cursor.Next() {
-		b, err := db.Read(cursor.Ref())
+		b, err := cursor.Blob()
 		if err != nil {
-			log.Fatalf("db.Read: %v", err)
+			log.Fatalf("cursor.Blob: %v", err)
 		}
 		var js interface{}
 		err = json.Unmarshal(b, &js)
 		if err != nil {
-			log.Fatalf("json.Unmarshal: %v", err)
+			// blobs written by a JSONWriter are known to be valid
+			log.Printf("skipping %s: json.Unmarshal: %v", cursor.QRef(), err)
+			continue
+		}
+
+		meta, err := cursor.Meta()
+		if err != nil {
+			log.Fatalf("cursor.Meta: %v", err)
 		}
 
 		m := make(map[string]interface{})
 		m["stored"] = js
-		m["ref"] = cursor.Ref().String()
+		m["ref"] = cursor.QRef().String()
 		m["sha1"] = fmt.Sprintf("%0x", sha1.Sum(b))
+		if meta != nil {
+			m["meta"] = meta
+		}
 
 		marsh, err := json.Marshal(m)
 		if err != nil {
@@ -128,3 +527,18 @@ func exportJSON(db *bobstore.DB) error {
 
 	return nil
 }
+
+// formatMeta formats metadata as key="value" pairs sorted by key
+func formatMeta(meta bobstore.Meta) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := ""
+	for _, k := range keys {
+		s += fmt.Sprintf(" %s=%q", k, meta[k])
+	}
+	return s
+}
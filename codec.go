@@ -12,8 +12,24 @@ import (
 // Codec for compression/decompression
 type Codec struct {
 	typ     string
+	flags   uint16
+	stages  []*Codec
 	encoder func([]byte) ([]byte, error)
 	decoder func([]byte) ([]byte, error)
+
+	// choose encodes with the codec of its choice, see AutoCodec
+	choose func([]byte) (*Codec, []byte, error)
+}
+
+// encode gives the encoded bytes and the codec that was used for them,
+// which differs from c if c chooses the codec
+func (c *Codec) encode(src []byte) (*Codec, []byte, error) {
+	if c.choose != nil {
+		return c.choose(src)
+	}
+
+	dst, err := c.encoder(src)
+	return c, dst, err
 }
 
 func encodeGZIP(src []byte) ([]byte, error) {
@@ -85,10 +101,13 @@ var codecs = make(map[string]*Codec)
 func init() {
 	codecs["SNAP"] = snappyCodec
 	codecs["GZIP"] = gzipCodec
+	codecs["MINJ"] = minifyJSONCodec
 }
 
-// CodecFor returns the codec for name
+// CodecFor returns the registered codec for name
 func CodecFor(name string) *Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
 	return codecs[name]
 }
 
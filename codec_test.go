@@ -2,7 +2,10 @@ package bobstore
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -65,3 +68,173 @@ func Test_Snappy(t *testing.T) {
 		t.Errorf("str<>b:%s\n%s", str, b)
 	}
 }
+
+func Test_Encrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+
+	keys := &StaticKeys{Current: 1, Keys: map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, KeySize),
+		2: bytes.Repeat([]byte{2}, KeySize),
+	}}
+
+	secret := "my social security number is 078-05-1120"
+	ref1, err := db.WriteWithCodec([]byte(secret), Encrypted(GZIPCodec(), keys))
+	if err != nil {
+		t.Fatalf("write encrypted: %v", err)
+	}
+	_, err = db.WriteWithCodec([]byte(secret), Encrypted(nil, keys))
+	if err == nil {
+		t.Errorf("write encrypted without codec should fail")
+	}
+	_, err = db.WriteWithCodec([]byte(secret), nil)
+	if err == nil {
+		t.Errorf("write without codec should fail")
+	}
+
+	// rotate the key
+	keys.Current = 2
+	ref2, err := db.WriteWithCodec([]byte(secret), Encrypted(SnappyCodec(), keys))
+	if err != nil {
+		t.Fatalf("write encrypted: %v", err)
+	}
+
+	_, err = db.Read(ref1)
+	if err == nil {
+		t.Errorf("reading an encrypted blob without KeyProvider should fail")
+	}
+
+	db.KeyProvider = keys
+	for _, ref := range []Ref{ref1, ref2} {
+		b, err := db.Read(ref)
+		if err != nil || string(b) != secret {
+			t.Errorf("read encrypted %s: %q %v", ref, b, err)
+		}
+	}
+
+	c := db.Cursor(Ref{})
+	if !c.Next() || !c.Encrypted() || c.Typ() != "GZIP" {
+		t.Errorf("first blob should be encrypted GZIP: %v %s", c.Encrypted(), c.Typ())
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "00000"))
+	if bytes.Contains(content, []byte("078-05-1120")) {
+		t.Errorf("data file contains the plain text")
+	}
+}
+
+func Test_Pipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+
+	p, err := NewPipeline("TMGZ", MinifyJSONCodec(), GZIPCodec())
+	if err != nil {
+		t.Fatalf("new pipeline: %v", err)
+	}
+	_, err = NewPipeline("TMGZ", SnappyCodec())
+	if err == nil {
+		t.Errorf("registering a pipeline twice should fail")
+	}
+
+	ref, err := db.WriteWithCodec([]byte("{ \"a\" : [ 1, 2 ] }"), p)
+	if err != nil {
+		t.Fatalf("write with pipeline: %v", err)
+	}
+	b, err := db.Read(ref)
+	if err != nil || string(b) != `{"a":[1,2]}` {
+		t.Errorf("read pipeline %s: %q %v", ref, b, err)
+	}
+
+	// a reader without the declaration uses the manifest
+	codecsLock.Lock()
+	delete(codecs, "TMGZ")
+	codecsLock.Unlock()
+
+	rdb, err := Open(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer rdb.Close()
+	b, err = rdb.Read(ref)
+	if err != nil || string(b) != `{"a":[1,2]}` {
+		t.Errorf("read pipeline from manifest %s: %q %v", ref, b, err)
+	}
+	if CodecFor("TMGZ") != nil || rdb.CodecFor("TMGZ") == nil {
+		t.Errorf("the db should give the pipeline recorded in its manifest")
+	}
+
+	// the recorded stages can not be changed
+	other, err := NewPipeline("TMGZ", GZIPCodec())
+	if err != nil {
+		t.Fatalf("new pipeline: %v", err)
+	}
+	_, err = db.WriteWithCodec([]byte("{}"), other)
+	if err == nil {
+		t.Errorf("writing a pipeline with other stages should fail")
+	}
+}
+
+func Test_AutoCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer db.Close()
+
+	auto := NewAutoCodec(SnappyCodec(), GZIPCodec())
+	// very repetitive, gzip wins
+	blob := bytes.Repeat([]byte("gzip compresses this better than snappy. "), 1000)
+	ref, err := db.WriteWithCodec(blob, auto.Codec())
+	if err != nil {
+		t.Fatalf("write auto: %v", err)
+	}
+
+	b, err := db.Read(ref)
+	if err != nil || !bytes.Equal(b, blob) {
+		t.Errorf("read auto %s: %v", ref, err)
+	}
+	c := db.Cursor(Ref{})
+	if !c.Next() || c.Typ() != "GZIP" {
+		t.Errorf("auto codec should have chosen GZIP, but: %s", c.Typ())
+	}
+
+	// no time at all: the fastest is chosen
+	auto.Objective = SmallestWithinBudget
+	auto.Budget = 0
+	auto.SampleEvery = 3
+	for i := 0; i < 3; i++ {
+		_, err = db.WriteWithCodec(blob, auto.Codec())
+		if err != nil {
+			t.Fatalf("write auto: %v", err)
+		}
+	}
+
+	stats := auto.Stats()
+	if stats["GZIP"]+stats["SNAP"] != 4 || stats["GZIP"] < 1 {
+		t.Errorf("stats should count 4 blobs: %v", stats)
+	}
+}
@@ -0,0 +1,205 @@
+package bobstore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeySize is the size of the AES-256 keys
+const KeySize = 32
+
+// KeyProvider gives the keys for encryption at rest.
+//
+// Every encrypted record carries the id of its key, so keys can be
+// rotated: new records use the current key, older records are
+// decrypted with the key they were written with.
+type KeyProvider interface {
+	// CurrentKey gives id and key for encrypting new records
+	CurrentKey() (uint32, []byte, error)
+
+	// Key gives the key with the id for decrypting
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider for a fixed set of keys.
+type StaticKeys struct {
+	// Current is the id of the key for encrypting
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+// CurrentKey gives id and key for encrypting new records
+func (k *StaticKeys) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key gives the key with the id for decrypting
+func (k *StaticKeys) Key(id uint32) ([]byte, error) {
+	key := k.Keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %d", id)
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads keys from a text file, one key per line:
+// the key id in decimal, whitespace and the hex encoded key.
+// Empty lines and lines starting with # are ignored.
+// The key with the highest id is the current key.
+func ReadKeyFile(name string) (*StaticKeys, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := &StaticKeys{Keys: make(map[uint32][]byte)}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: can not parse key line", name)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: key id", name)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("%s: key %d must be %d hex encoded bytes", name, id, KeySize)
+		}
+
+		keys.Keys[uint32(id)] = key
+		if uint32(id) >= keys.Current {
+			keys.Current = uint32(id)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", name)
+	}
+
+	return keys, nil
+}
+
+// Encrypted returns a codec that encodes with base, then encrypts
+// with AES-256-GCM using the current key of keys.
+//
+// The record keeps the typ of the base codec and is marked as encrypted
+// in the header.  Reading it requires DB.KeyProvider to give the key.
+// Writes with the codec fail if base is nil, e.g. an unknown codec.
+func Encrypted(base *Codec, keys KeyProvider) *Codec {
+	if base == nil {
+		return &Codec{
+			choose: func(src []byte) (*Codec, []byte, error) {
+				return nil, nil, errors.New("no codec to encrypt with")
+			},
+		}
+	}
+
+	return &Codec{
+		typ:    base.typ,
+		flags:  base.flags | flagEncrypted,
+		stages: base.stages,
+		// base may choose the codec, so the typ is only known after encoding
+		choose: func(src []byte) (*Codec, []byte, error) {
+			used, dst, err := base.encode(src)
+			if err != nil {
+				return used, nil, err
+			}
+			dst, err = encrypt(keys, used.typ, dst)
+			if err != nil {
+				return used, nil, err
+			}
+			return &Codec{typ: used.typ, flags: used.flags | flagEncrypted, stages: used.stages}, dst, nil
+		},
+		decoder: base.decoder,
+	}
+}
+
+// encrypted bytes: key id (4 bytes), nonce, sealed bytes with tag.
+// the typ is authenticated as additional data.
+func encrypt(keys KeyProvider, typ string, src []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "current key")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(src)+aead.Overhead())
+	binary.LittleEndian.PutUint32(dst, id)
+	nonce := dst[4:]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "nonce")
+	}
+
+	return aead.Seal(dst, nonce, src, []byte(typ)), nil
+}
+
+func decrypt(keys KeyProvider, typ string, src []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, errors.New("encrypted blob, but no KeyProvider")
+	}
+	if len(src) < 4 {
+		return nil, errors.New("encrypted blob too short")
+	}
+
+	id := binary.LittleEndian.Uint32(src)
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(src) < 4+aead.NonceSize() {
+		return nil, errors.New("encrypted blob too short")
+	}
+	nonce := src[4 : 4+aead.NonceSize()]
+	dst, err := aead.Open(nil, nonce, src[4+aead.NonceSize():], []byte(typ))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypt with key %d", id)
+	}
+
+	return dst, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, not %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,176 @@
+package bobstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// fileMagic starts every data file since format version 1
+const fileMagic = "BOBSTORE"
+
+// formatVersion is the version of new data files
+//
+// 0 - legacy files without file header, the first record is at position 0
+// 1 - file header, the first record is at position fileHeaderSize
+const formatVersion = 1
+
+// fileHeaderSize 16 bytes, so records stay 64bit aligned
+const fileHeaderSize = 16
+
+// the fileHeader precedes the records of a data file
+type fileHeader struct {
+	Magic [8]byte
+
+	// format version of the data file
+	Version uint32
+
+	// reserved for future use
+	_ uint32
+}
+
+type fileHeaderBytes [fileHeaderSize]byte
+
+// VersionError is returned for data files with an unknown format version
+type VersionError struct {
+	Fno     uint32
+	Version uint32
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("data file %05d has format version %d, only versions up to %d are supported",
+		e.Fno, e.Version, formatVersion)
+}
+
+// readFileHeader determines format version and start position of the data file.
+// Empty files of a read-write db get a file header with the current version.
+//
+// A read-only db may find the file header incomplete, the writer has just
+// created the file.  The file then has no records yet and the header is
+// read again the next time, see dbFile.pending.
+func readFileHeader(db *DB, fno uint32, dbf *dbFile) error {
+	var fhb fileHeaderBytes
+	n, err := dbf.file.ReadAt(fhb[:], 0)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "read file header %05d", fno)
+	}
+
+	// a legacy file has at least the header of its first record
+	dbf.pending = n < fileHeaderSize && db.writer == nil
+	if dbf.pending {
+		dbf.version = formatVersion
+		dbf.start = fileHeaderSize
+		return nil
+	}
+
+	if n == 0 && db.writer != nil {
+		fh := fileHeader{Version: formatVersion}
+		copy(fh.Magic[:], fileMagic)
+		_, err = dbf.file.WriteAt((*fileHeaderBytes)(unsafe.Pointer(&fh))[:], 0)
+		if err != nil {
+			return errors.Wrapf(err, "write file header %05d", fno)
+		}
+		dbf.version = formatVersion
+		dbf.start = fileHeaderSize
+		return nil
+	}
+
+	fh := (*fileHeader)(unsafe.Pointer(&fhb[0]))
+	if n < fileHeaderSize || string(fh.Magic[:]) != fileMagic {
+		// legacy file, starts directly with the first record
+		dbf.version = 0
+		dbf.start = 0
+		return nil
+	}
+
+	switch fh.Version {
+	case 1:
+		dbf.version = fh.Version
+		dbf.start = fileHeaderSize
+	default:
+		return &VersionError{Fno: fno, Version: fh.Version}
+	}
+
+	return nil
+}
+
+// checkFormat refuses dbs with data files of an unknown format version
+func checkFormat(db *DB) error {
+	fnos, err := dataFiles(db)
+	if err != nil {
+		return err
+	}
+
+	for _, fno := range fnos {
+		err = checkFileFormat(db, fno)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFileFormat reads the file header of data file fno without keeping it open
+func checkFileFormat(db *DB, fno uint32) error {
+	f, err := os.Open(dataFileName(db, fno))
+	if err != nil {
+		return errors.Wrapf(err, "open data file %05d", fno)
+	}
+	defer f.Close()
+
+	var fhb fileHeaderBytes
+	n, err := f.ReadAt(fhb[:], 0)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "read file header %05d", fno)
+	}
+
+	fh := (*fileHeader)(unsafe.Pointer(&fhb[0]))
+	if n == fileHeaderSize && string(fh.Magic[:]) == fileMagic && fh.Version > formatVersion {
+		return &VersionError{Fno: fno, Version: fh.Version}
+	}
+	return nil
+}
+
+func getDataFile(db *DB, fno uint32) (*dbFile, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return xGetDataFile(db, fno)
+}
+
+// x means mutex is acquired
+func xGetDataFile(db *DB, fno uint32) (*dbFile, error) {
+	if dbf := db.files[fno]; dbf != nil {
+		if dbf.pending {
+			err := readFileHeader(db, fno, dbf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dbf, nil
+	}
+
+	name := xDataFileName(db, fno)
+	f, err := os.OpenFile(name, db.openflags, 0666)
+	if os.IsNotExist(err) && xReloadTiers(db) {
+		f, err = os.OpenFile(xDataFileName(db, fno), db.openflags, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dbf := &dbFile{file: f}
+	err = readFileHeader(db, fno, dbf)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	db.files[fno] = dbf
+
+	// XXX: mark file as recently used, close files that have been open too long
+
+	return dbf, nil
+}
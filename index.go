@@ -0,0 +1,493 @@
+package bobstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// indexFilePrefix is the file name prefix of index files
+// the rest of the name is derived from the json path
+const indexFilePrefix = "_index."
+
+// An index maps values at a json path to the refs of the blobs containing them.
+//
+// Index files are append-only text files: the first line is the json path,
+// followed by lines "REF\tVALUE" with a quoted value.  Lines "#REF" record
+// the committed position up to which all blobs have been indexed.
+type index struct {
+	path string
+	expr []interface{}
+	file *os.File
+	refs map[string][]Ref
+	// all blobs before next are indexed
+	next Ref
+	// indexed blobs at or after next, catching up and the writes
+	// of blobs in flight must not add them again
+	indexed map[Ref]bool
+}
+
+// parseJSONPath parses a simple json path: $.order.id or $.items[0].sku
+// Elements are object keys (string) or array indexes (int)
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("json path must start with $: %s", path)
+	}
+
+	var expr []interface{}
+	s := path[1:]
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end == -1 {
+				end = len(s) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in json path: %s", path)
+			}
+			expr = append(expr, s[1:end+1])
+			s = s[end+1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated [ in json path: %s", path)
+			}
+			i, err := strconv.Atoi(s[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid array index in json path: %s", path)
+			}
+			expr = append(expr, i)
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("can not parse json path: %s", path)
+		}
+	}
+
+	return expr, nil
+}
+
+// extract the value at the path.  only scalars are indexed,
+// strings by their value, everything else by its json representation.
+func extractJSONPath(v interface{}, expr []interface{}) (string, bool) {
+	for _, e := range expr {
+		switch e := e.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			v, ok = m[e]
+			if !ok {
+				return "", false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || e >= len(a) {
+				return "", false
+			}
+			v = a[e]
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+func indexFileName(db *DB, path string) string {
+	return filepath.Join(db.name, fmt.Sprintf("%s%x", indexFilePrefix, sha1.Sum([]byte(path))))
+}
+
+// AddIndex indexes the values found at the json path (e.g. $.order.id).
+//
+// The index is persisted in the db directory and maintained on every
+// write of a read-write db that has the index.  Indexes that exist in
+// the db directory are loaded on open, an index that does not exist
+// yet is built by scanning the whole db.
+func (db *DB) AddIndex(path string) error {
+	db.ilock.Lock()
+	defer db.ilock.Unlock()
+
+	if db.indexes[path] != nil {
+		return nil
+	}
+
+	return xLoadIndex(db, indexFileName(db, path), path)
+}
+
+// RebuildIndex rebuilds the index for the json path by scanning the whole db.
+func (db *DB) RebuildIndex(path string) error {
+	db.ilock.Lock()
+	defer db.ilock.Unlock()
+
+	idx := db.indexes[path]
+	if idx == nil {
+		return fmt.Errorf("no index for %s", path)
+	}
+
+	idx.refs = make(map[string][]Ref)
+	idx.next = Ref{}
+	idx.indexed = make(map[Ref]bool)
+	if idx.file != nil {
+		err := idx.file.Truncate(0)
+		if err != nil {
+			return errors.Wrap(err, "truncate index")
+		}
+		// O_APPEND: writes go to the end of the truncated file
+		_, err = idx.file.Write([]byte(strconv.Quote(path) + "\n"))
+		if err != nil {
+			return errors.Wrap(err, "write index")
+		}
+	}
+
+	return xCatchUpIndex(db, idx)
+}
+
+// HasIndex is true if the db has an index for the json path,
+// e.g. loaded from the db directory on open
+func (db *DB) HasIndex(path string) bool {
+	db.ilock.RLock()
+	defer db.ilock.RUnlock()
+	return db.indexes[path] != nil
+}
+
+// FindBy returns the refs of all blobs where the value at
+// the indexed json path is value.
+func (db *DB) FindBy(path, value string) ([]Ref, error) {
+	db.ilock.RLock()
+	defer db.ilock.RUnlock()
+
+	idx := db.indexes[path]
+	if idx == nil {
+		return nil, fmt.Errorf("no index for %s", path)
+	}
+
+	refs := idx.refs[value]
+	return append([]Ref(nil), refs...), nil
+}
+
+// loadIndexes loads all index files in the db directory
+func loadIndexes(db *DB) error {
+	names, err := filepath.Glob(filepath.Join(db.name, indexFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+
+	db.ilock.Lock()
+	defer db.ilock.Unlock()
+
+	for _, name := range names {
+		err = xLoadIndex(db, name, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// x means ilock is acquired.  path is empty if it should be taken from the file.
+func xLoadIndex(db *DB, name, path string) error {
+	idx := &index{path: path, refs: make(map[string][]Ref), indexed: make(map[Ref]bool)}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "read index %s", name)
+	}
+
+	if len(content) > 0 {
+		err = parseIndex(idx, content)
+		if err != nil {
+			return errors.Wrapf(err, "parse index %s", name)
+		}
+	} else if path == "" {
+		return fmt.Errorf("empty index file: %s", name)
+	}
+
+	idx.expr, err = parseJSONPath(idx.path)
+	if err != nil {
+		return err
+	}
+
+	if db.writer != nil {
+		idx.file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return errors.Wrapf(err, "open index %s", name)
+		}
+		if len(content) == 0 {
+			_, err = idx.file.Write([]byte(strconv.Quote(idx.path) + "\n"))
+			if err != nil {
+				return errors.Wrap(err, "write index")
+			}
+		}
+	}
+
+	db.indexes[idx.path] = idx
+
+	return xCatchUpIndex(db, idx)
+}
+
+func parseIndex(idx *index, content []byte) error {
+	r := bufio.NewReader(bytes.NewReader(content))
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return errors.New("missing json path")
+	}
+	path, err := strconv.Unquote(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		return errors.Wrap(err, "json path")
+	}
+	if idx.path != "" && idx.path != path {
+		return fmt.Errorf("index is for %s, not %s", path, idx.path)
+	}
+	idx.path = path
+
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			// EOF, an incomplete last line is ignored:
+			// the process died while writing it
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if strings.HasPrefix(line, "#") {
+			ref, err := ParseRef(line[1:])
+			if err != nil {
+				continue
+			}
+			if idx.next.Less(ref) {
+				idx.next = ref
+			}
+			continue
+		}
+
+		tab := strings.IndexByte(line, '\t')
+		if tab == -1 {
+			continue
+		}
+		ref, err := ParseRef(line[:tab])
+		if err != nil {
+			continue
+		}
+		value, err := strconv.Unquote(line[tab+1:])
+		if err != nil {
+			continue
+		}
+		idx.refs[value] = append(idx.refs[value], ref)
+	}
+
+	// catching up starts at next again
+	for _, refs := range idx.refs {
+		for _, ref := range refs {
+			if !ref.Less(idx.next) {
+				idx.indexed[ref] = true
+			}
+		}
+	}
+	return nil
+}
+
+// xCatchUpIndex indexes the blobs written after idx.next
+func xCatchUpIndex(db *DB, idx *index) error {
+	// all blobs before it are completely written, so the cursor sees them
+	committed, err := committedWatermark(db)
+	if err != nil {
+		return err
+	}
+
+	c := db.CursorRange(idx.next, snapshotWatermark(committed))
+	c.SetReadAhead(scanReadAhead)
+	for c.Next() {
+		b, err := c.Blob()
+		if err != nil {
+			return err
+		}
+		err = xCatchUpBlob(idx, c.Ref(), b)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Error() != nil {
+		return c.Error()
+	}
+
+	err = xCatchUpTail(db, idx, committed)
+	if err != nil {
+		return err
+	}
+
+	// only the writes of blobs after committed are still to come
+	for ref := range idx.indexed {
+		if ref.Less(committed) {
+			delete(idx.indexed, ref)
+		}
+	}
+	if !idx.next.Less(committed) {
+		return nil
+	}
+	idx.next = committed
+	if idx.file != nil {
+		_, err = idx.file.Write([]byte("#" + committed.String() + "\n"))
+		if err != nil {
+			return errors.Wrap(err, "write index")
+		}
+	}
+	return nil
+}
+
+// xCatchUpTail indexes the blobs after committed that are completely
+// written, their writes may have been before the index existed.  Records
+// still being written are skipped, their writes index them.
+func xCatchUpTail(db *DB, idx *index, committed Ref) error {
+	if db.writer == nil {
+		return nil
+	}
+
+	db.lock.Lock()
+	end := db.writePos
+	pending := make(map[Ref]bool, len(db.pending))
+	for _, ref := range db.pending {
+		pending[ref] = true
+	}
+	db.lock.Unlock()
+
+	from := Ref{Fno: committed.Fno, Pos: committed.Pos}
+	if from.Less(idx.next) {
+		from = idx.next
+	}
+
+	// the header of a record being written may still be zero
+	c := db.CursorRange(from, end)
+	c.SetRecovery(func(fno uint32, start, end uint32) {})
+	for c.Next() {
+		ref := c.Ref()
+		if pending[Ref{Fno: ref.Fno, Pos: ref.Pos}] {
+			continue
+		}
+		b, err := c.Blob()
+		if err != nil {
+			return err
+		}
+		err = xCatchUpBlob(idx, ref, b)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Error()
+}
+
+// xCatchUpBlob indexes a blob found while catching up
+func xCatchUpBlob(idx *index, ref Ref, b []byte) error {
+	v, err := decodeJSON(b)
+	if err != nil {
+		// not json, nothing to index
+		return nil
+	}
+	return xIndexBlob(idx, ref, v, true)
+}
+
+// indexBlob adds the blob to all indexes of the db
+func indexBlob(db *DB, ref Ref, b []byte) error {
+	db.ilock.Lock()
+	defer db.ilock.Unlock()
+
+	if len(db.indexes) == 0 {
+		return nil
+	}
+
+	v, err := decodeJSON(b)
+	if err != nil {
+		// not json, nothing to index
+		return nil
+	}
+
+	for _, idx := range db.indexes {
+		err = xIndexBlob(idx, ref, v, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xIndexBlob adds the blob to the index.  Blobs indexed while catching up
+// are remembered, their write may still want to index them.
+func xIndexBlob(idx *index, ref Ref, v interface{}, catchingUp bool) error {
+	value, ok := extractJSONPath(v, idx.expr)
+	if !ok {
+		return nil
+	}
+
+	if idx.indexed[ref] {
+		if !catchingUp {
+			delete(idx.indexed, ref)
+		}
+		return nil
+	}
+	if catchingUp {
+		idx.indexed[ref] = true
+	}
+
+	idx.refs[value] = append(idx.refs[value], ref)
+	if idx.file != nil {
+		_, err := idx.file.Write([]byte(ref.String() + "\t" + strconv.Quote(value) + "\n"))
+		if err != nil {
+			return errors.Wrap(err, "write index")
+		}
+	}
+	return nil
+}
+
+// closeIndexes records the committed position and closes the index files
+func closeIndexes(db *DB) (xerr error) {
+	db.ilock.Lock()
+	defer db.ilock.Unlock()
+
+	wpos := committedPosition(db)
+
+	for _, idx := range db.indexes {
+		if idx.file == nil {
+			continue
+		}
+		_, err := idx.file.Write([]byte("#" + wpos.String() + "\n"))
+		if err != nil {
+			xerr = err
+		}
+		err = idx.file.Close()
+		if err != nil {
+			xerr = err
+		}
+	}
+	db.indexes = nil
+
+	return
+}
@@ -0,0 +1,108 @@
+package bobstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// InvalidJSONError is returned by JSONWriter for blobs that are not valid JSON.
+type InvalidJSONError struct {
+	Err error
+}
+
+func (e *InvalidJSONError) Error() string {
+	if e.Err == nil {
+		return "invalid json"
+	}
+	return "invalid json: " + e.Err.Error()
+}
+
+// Cause returns the underlying error, if any
+func (e *InvalidJSONError) Cause() error {
+	return e.Err
+}
+
+// JSONWriter only writes valid JSON blobs.
+//
+// Blobs written by it are marked in the header,
+// see Cursor.JSON().
+type JSONWriter struct {
+	db *DB
+
+	// Codec for writing, default is the SnappyCodec()
+	Codec *Codec
+
+	// Canonicalize sorts object keys and removes insignificant whitespace
+	// so identical documents are stored identically.
+	Canonicalize bool
+}
+
+// NewJSONWriter returns a JSONWriter for the db using the SnappyCodec()
+func NewJSONWriter(db *DB) *JSONWriter {
+	return &JSONWriter{db: db, Codec: snappyCodec}
+}
+
+// Write the JSON blob, returns an *InvalidJSONError if b is not valid JSON.
+func (w *JSONWriter) Write(b []byte) (Ref, error) {
+	return w.WriteWithMeta(b, nil)
+}
+
+// WriteWithMeta writes the JSON blob with metadata.
+func (w *JSONWriter) WriteWithMeta(b []byte, meta Meta) (Ref, error) {
+	var err error
+	if w.Canonicalize {
+		b, err = canonicalJSON(b)
+		if err != nil {
+			return Ref{}, err
+		}
+	} else if !json.Valid(b) {
+		return Ref{}, &InvalidJSONError{Err: validJSONError(b)}
+	}
+
+	mb, err := meta.encode()
+	if err != nil {
+		return Ref{}, err
+	}
+
+	return w.db.write(b, w.Codec, mb, flagJSON)
+}
+
+// validJSONError gives the reason why b is not valid json
+func validJSONError(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err == nil {
+		err = errors.New("json.Valid failed")
+	}
+	return err
+}
+
+// canonicalJSON sorts object keys and removes insignificant whitespace.
+// Numbers are kept as they are.
+func canonicalJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, &InvalidJSONError{Err: err}
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, &InvalidJSONError{Err: errors.New("trailing data after json value")}
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Encode")
+	}
+
+	// Encode terminates the value with a newline
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,176 @@
+package bobstore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// manifestFile is the name of the manifest file
+const manifestFile = "_manifest"
+
+// the manifest describes the db, it is stored as json in the db directory
+type manifest struct {
+	// StoreID identifies the store in extended refs, 0 for stores without id
+	StoreID uint16 `json:"store_id,omitempty"`
+
+	// Pipelines maps the typ of a pipeline codec to the typs of its stages
+	Pipelines map[string][]string `json:"pipelines,omitempty"`
+
+	// ColdDirs are the directories of the cold tier, see DB.MigrateCold
+	ColdDirs []string `json:"cold_dirs,omitempty"`
+	// ColdFiles are the data files in the cold tier, sorted by number
+	ColdFiles []coldFile `json:"cold_files,omitempty"`
+
+	// MaxFiles is DB.MaxFiles of the writer, 0 for MaxNumberFilesV2
+	MaxFiles uint32 `json:"max_files,omitempty"`
+
+	// the single cold directory and its files of older manifests
+	ColdDir string   `json:"cold_dir,omitempty"`
+	Cold    []uint32 `json:"cold,omitempty"`
+}
+
+// coldFile is a data file in the cold tier
+type coldFile struct {
+	Fno uint32 `json:"fno"`
+	// Dir is one of ColdDirs
+	Dir string `json:"dir"`
+}
+
+// upgrade converts the single cold directory of older manifests
+func (m *manifest) upgrade() {
+	if m.ColdDir == "" {
+		return
+	}
+
+	if m.coldDirIndex(m.ColdDir) == -1 {
+		m.ColdDirs = append(m.ColdDirs, m.ColdDir)
+	}
+	for _, fno := range m.Cold {
+		if _, ok := m.coldDir(fno); !ok {
+			m.ColdFiles = append(m.ColdFiles, coldFile{Fno: fno, Dir: m.ColdDir})
+		}
+	}
+	sort.Slice(m.ColdFiles, func(i, j int) bool { return m.ColdFiles[i].Fno < m.ColdFiles[j].Fno })
+	m.ColdDir = ""
+	m.Cold = nil
+}
+
+// readManifest reads the manifest, a missing manifest is empty
+func readManifest(db *DB) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return xReadManifest(db)
+}
+
+// x means mutex is acquired
+func xReadManifest(db *DB) error {
+	m, err := readManifestFile(db.name)
+	if err != nil {
+		return err
+	}
+
+	db.manifest = m
+	if m.MaxFiles != 0 {
+		db.MaxFiles = m.MaxFiles
+	}
+	// shards of older dbs only have the id assigned in memory, see ShardedDB
+	if m.StoreID != 0 {
+		db.storeID = m.StoreID
+	}
+
+	return nil
+}
+
+// readManifestFile reads the manifest in the db directory name,
+// a missing manifest is empty
+func readManifestFile(name string) (*manifest, error) {
+	m := &manifest{}
+
+	b, err := ioutil.ReadFile(filepath.Join(name, manifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	if err == nil {
+		err = json.Unmarshal(b, m)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse manifest")
+		}
+		m.upgrade()
+	}
+
+	return m, nil
+}
+
+// ensureStoreID gives the store an id if it has none yet
+func ensureStoreID(db *DB) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.manifest.StoreID != 0 {
+		return nil
+	}
+
+	var b [2]byte
+	for binary.LittleEndian.Uint16(b[:]) == 0 {
+		_, err := rand.Read(b[:])
+		if err != nil {
+			return errors.Wrap(err, "store id")
+		}
+	}
+	db.manifest.StoreID = binary.LittleEndian.Uint16(b[:])
+	db.storeID = db.manifest.StoreID
+
+	return xWriteManifest(db)
+}
+
+// assignStoreID sets the store id, a read-write db records it in the manifest
+func assignStoreID(db *DB, id uint16) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.storeID = id
+	if db.writer == nil {
+		return nil
+	}
+	db.manifest.StoreID = id
+	return xWriteManifest(db)
+}
+
+// xAdoptManifest takes store id and pipelines from the manifest of another
+// copy of the db, a primary or a backup.  The tiers stay local.
+// x means mutex is acquired.
+func xAdoptManifest(db *DB, m *manifest) error {
+	adopted := *m
+	adopted.ColdDirs = db.manifest.ColdDirs
+	adopted.ColdFiles = db.manifest.ColdFiles
+	adopted.ColdDir = ""
+	adopted.Cold = nil
+	adopted.MaxFiles = db.manifest.MaxFiles
+
+	db.manifest = &adopted
+	db.storeID = adopted.StoreID
+	return xWriteManifest(db)
+}
+
+// x means mutex is acquired.  the manifest is replaced atomically.
+func xWriteManifest(db *DB) error {
+	b, err := json.MarshalIndent(db.manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal manifest")
+	}
+
+	name := filepath.Join(db.name, manifestFile)
+	err = ioutil.WriteFile(name+".tmp", b, 0666)
+	if err != nil {
+		return errors.Wrap(err, "write manifest")
+	}
+
+	return os.Rename(name+".tmp", name)
+}
@@ -0,0 +1,69 @@
+package bobstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// maxMetaLength is the maximum size of the encoded metadata: 64k - 1
+const maxMetaLength = 0xFFFF
+
+// Meta is optional user metadata stored with a blob,
+// e.g. content type, source system or tags.
+//
+// It is stored uncompressed after the header as a sequence
+// of key/value pairs, each length-prefixed (uvarint) and sorted by key.
+type Meta map[string]string
+
+func (m Meta) encode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	var lb [binary.MaxVarintLen64]byte
+	for _, k := range keys {
+		for _, s := range []string{k, m[k]} {
+			n := binary.PutUvarint(lb[:], uint64(len(s)))
+			b = append(b, lb[:n]...)
+			b = append(b, s...)
+		}
+	}
+
+	if len(b) > maxMetaLength {
+		return nil, fmt.Errorf("metadata too large: %d bytes", len(b))
+	}
+
+	return b, nil
+}
+
+func decodeMeta(b []byte) (Meta, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	m := make(Meta)
+	var kv [2]string
+	for len(b) > 0 {
+		for i := range kv {
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errors.New("corrupt metadata")
+			}
+			kv[i] = string(b[n : n+int(l)])
+			b = b[n+int(l):]
+		}
+		m[kv[0]] = kv[1]
+	}
+
+	return m, nil
+}
@@ -0,0 +1,212 @@
+package bobstore
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// QRef is a ref qualified with the prefix of its db in a MultiDB
+type QRef struct {
+	Prefix string
+	Ref    Ref
+}
+
+// String gives PREFIX/REF, just the ref without prefix
+func (q QRef) String() string {
+	if q.Prefix == "" {
+		return q.Ref.String()
+	}
+	return q.Prefix + "/" + q.Ref.String()
+}
+
+// ParseQRef parses the string representation of a qualified ref,
+// a ref without prefix has an empty prefix
+func ParseQRef(s string) (QRef, error) {
+	var q QRef
+	i := strings.LastIndexByte(s, '/')
+	if i != -1 {
+		q.Prefix = s[:i]
+		s = s[i+1:]
+	}
+
+	var err error
+	q.Ref, err = ParseRef(s)
+	return q, err
+}
+
+// MultiDB is a read-only view of several dbs, e.g. one per month.
+//
+// Every db has a prefix, the base name of its directory, which
+// qualifies the refs of its blobs.  Cursors visit the dbs in the
+// order they were opened.
+type MultiDB struct {
+	dbs      []*DB
+	prefixes []string
+	byPrefix map[string]*DB
+}
+
+// OpenMulti opens the dbs for reading
+func OpenMulti(names ...string) (*MultiDB, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no dbs")
+	}
+
+	m := &MultiDB{byPrefix: make(map[string]*DB)}
+	for _, name := range names {
+		prefix := filepath.Base(filepath.Clean(name))
+		if m.byPrefix[prefix] != nil {
+			m.Close()
+			return nil, errors.Errorf("two dbs with prefix %s", prefix)
+		}
+
+		db, err := Open(name)
+		if err != nil {
+			m.Close()
+			return nil, errors.Wrapf(err, "open %s", name)
+		}
+		m.dbs = append(m.dbs, db)
+		m.prefixes = append(m.prefixes, prefix)
+		m.byPrefix[prefix] = db
+	}
+
+	return m, nil
+}
+
+// Close all dbs
+func (m *MultiDB) Close() (xerr error) {
+	for _, db := range m.dbs {
+		err := db.Close()
+		if err != nil {
+			xerr = err
+		}
+	}
+	return
+}
+
+// DBs gives the dbs in the order they were opened
+func (m *MultiDB) DBs() []*DB {
+	return append([]*DB(nil), m.dbs...)
+}
+
+// Prefixes gives the prefixes of the dbs in the order they were opened
+func (m *MultiDB) Prefixes() []string {
+	return append([]string(nil), m.prefixes...)
+}
+
+// db gives the db of the qualified ref, the only one for refs without prefix
+func (m *MultiDB) db(q QRef) (*DB, error) {
+	if q.Prefix == "" && len(m.dbs) == 1 {
+		return m.dbs[0], nil
+	}
+
+	db := m.byPrefix[q.Prefix]
+	if db == nil {
+		return nil, errors.Wrapf(ErrInvalidRef, "%s: no db with prefix %q", q, q.Prefix)
+	}
+	return db, nil
+}
+
+// Read the blob at the qualified ref
+func (m *MultiDB) Read(q QRef) ([]byte, error) {
+	db, err := m.db(q)
+	if err != nil {
+		return nil, err
+	}
+	return db.Read(q.Ref)
+}
+
+// Cursor iterates over the dbs one after the other, Cursor.QRef gives the
+// qualified refs.  A null next means the beginning of the first db,
+// otherwise the cursor starts at next and continues with the following dbs.
+func (m *MultiDB) Cursor(next QRef) *Cursor {
+	return m.cursor(next, func(i int, from Ref) *Cursor {
+		return m.dbs[i].Cursor(from)
+	})
+}
+
+// cursor chains the cursors of the dbs from the one of next on
+func (m *MultiDB) cursor(next QRef, cursor func(i int, from Ref) *Cursor) *Cursor {
+	chain := make([]*Cursor, 0, len(m.dbs))
+	start, err := m.db(next)
+	if next == (QRef{}) {
+		start, err = m.dbs[0], nil
+	}
+
+	for i, db := range m.dbs {
+		switch {
+		case db == start:
+			chain = append(chain, cursor(i, next.Ref))
+		case len(chain) > 0:
+			chain = append(chain, cursor(i, Ref{}))
+		default:
+			continue
+		}
+		chain[len(chain)-1].prefix = m.prefixes[i]
+	}
+
+	return &Cursor{chain: chain, err: err}
+}
+
+// MultiSnapshot is a snapshot of every db of a MultiDB, see DB.Snapshot
+type MultiSnapshot struct {
+	m     *MultiDB
+	snaps []*Snapshot
+}
+
+// Snapshot pins a view of every db at its committed position
+func (m *MultiDB) Snapshot() (*MultiSnapshot, error) {
+	ms := &MultiSnapshot{m: m}
+	for i, db := range m.dbs {
+		snap, err := db.Snapshot()
+		if err != nil {
+			return nil, errors.Wrapf(err, "snapshot %s", m.prefixes[i])
+		}
+		ms.snaps = append(ms.snaps, snap)
+	}
+	return ms, nil
+}
+
+// SnapshotAt pins a view at the watermarks of an earlier snapshot,
+// one for every db, see MultiSnapshot.Watermarks
+func (m *MultiDB) SnapshotAt(watermarks ...QRef) (*MultiSnapshot, error) {
+	at := make(map[*DB]Ref)
+	for _, q := range watermarks {
+		db, err := m.db(q)
+		if err != nil {
+			return nil, err
+		}
+		at[db] = q.Ref
+	}
+
+	ms := &MultiSnapshot{m: m}
+	for i, db := range m.dbs {
+		watermark, ok := at[db]
+		if !ok {
+			return nil, errors.Errorf("no watermark for %s", m.prefixes[i])
+		}
+		snap, err := db.SnapshotAt(watermark)
+		if err != nil {
+			return nil, errors.Wrapf(err, "snapshot %s", m.prefixes[i])
+		}
+		ms.snaps = append(ms.snaps, snap)
+	}
+	return ms, nil
+}
+
+// Watermarks gives the qualified watermarks of the snapshots of the dbs
+func (ms *MultiSnapshot) Watermarks() []QRef {
+	watermarks := make([]QRef, len(ms.snaps))
+	for i, snap := range ms.snaps {
+		watermarks[i] = QRef{Prefix: ms.m.prefixes[i], Ref: snap.Watermark()}
+	}
+	return watermarks
+}
+
+// Cursor iterates over the snapshots of the dbs one after the other, see MultiDB.Cursor
+func (ms *MultiSnapshot) Cursor(next QRef) *Cursor {
+	return ms.m.cursor(next, func(i int, from Ref) *Cursor {
+		return ms.snaps[i].Cursor(from)
+	})
+}
@@ -0,0 +1,136 @@
+package bobstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_MultiDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	months := []string{"2026-01", "2026-02", "2026-03"}
+	var names []string
+	var blobs []string
+	for _, month := range months {
+		name := filepath.Join(dir, month)
+		names = append(names, name)
+		db, err := OpenRW(name)
+		if err != nil {
+			t.Fatalf("can not open db: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			blob := fmt.Sprintf("%s blob %d", month, i)
+			_, err = db.Write([]byte(blob))
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			blobs = append(blobs, blob)
+		}
+		db.Close()
+	}
+
+	m, err := OpenMulti(names...)
+	if err != nil {
+		t.Fatalf("can not open multi db: %v", err)
+	}
+	defer m.Close()
+
+	var qrefs []QRef
+	c := m.Cursor(QRef{})
+	for c.Next() {
+		b, err := c.Blob()
+		if err != nil || string(b) != blobs[len(qrefs)] {
+			t.Errorf("cursor at %s should give %q, but: %q %v", c.QRef(), blobs[len(qrefs)], b, err)
+		}
+		qrefs = append(qrefs, c.QRef())
+	}
+	if c.Error() != nil || len(qrefs) != len(blobs) {
+		t.Fatalf("cursor should visit all %d blobs in order, but: %d %v", len(blobs), len(qrefs), c.Error())
+	}
+
+	for i, q := range qrefs {
+		if q.Prefix != months[i/5] {
+			t.Errorf("%s should have prefix %s", q, months[i/5])
+		}
+		parsed, err := ParseQRef(q.String())
+		if err != nil || parsed != q {
+			t.Errorf("%s should parse to itself, but: %s %v", q, parsed, err)
+		}
+		b, err := m.Read(parsed)
+		if err != nil || string(b) != blobs[i] {
+			t.Errorf("read %s should give %q, but: %q %v", q, blobs[i], b, err)
+		}
+	}
+
+	// the same position in another db is another blob
+	if qrefs[0].Ref.Compare(qrefs[5].Ref) != 0 {
+		t.Errorf("the first blobs of two dbs should be at the same position: %s %s", qrefs[0], qrefs[5])
+	}
+	_, err = m.Read(QRef{Ref: qrefs[0].Ref})
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("refs without prefix should fail with ErrInvalidRef, but: %v", err)
+	}
+	_, err = m.Read(QRef{Prefix: "2025-12", Ref: qrefs[0].Ref})
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("refs with unknown prefix should fail with ErrInvalidRef, but: %v", err)
+	}
+
+	// continuing from the middle of the second db
+	n := 0
+	for c = m.Cursor(qrefs[7]); c.Next(); n++ {
+		if c.QRef() != qrefs[7+n] {
+			t.Errorf("cursor from %s should be at %s, but: %s", qrefs[7], qrefs[7+n], c.QRef())
+		}
+	}
+	if c.Error() != nil || n != len(qrefs)-7 {
+		t.Errorf("cursor from %s should visit %d blobs, but: %d %v", qrefs[7], len(qrefs)-7, n, c.Error())
+	}
+
+	// snapshots do not see later writes
+	snap, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	db, err := OpenRW(names[1])
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	_, err = db.Write([]byte("after the snapshot"))
+	db.Close()
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	again, err := m.SnapshotAt(snap.Watermarks()...)
+	if err != nil {
+		t.Fatalf("snapshot at %v: %v", snap.Watermarks(), err)
+	}
+	for _, ms := range []*MultiSnapshot{snap, again} {
+		n = 0
+		for c = ms.Cursor(QRef{}); c.Next(); n++ {
+			if c.QRef() != qrefs[n] {
+				t.Errorf("snapshot cursor should be at %s, but: %s", qrefs[n], c.QRef())
+			}
+		}
+		if c.Error() != nil || n != len(qrefs) {
+			t.Errorf("snapshot cursor should visit %d blobs, but: %d %v", len(qrefs), n, c.Error())
+		}
+	}
+	_, err = m.SnapshotAt(snap.Watermarks()[1:]...)
+	if err == nil {
+		t.Errorf("snapshot without the watermark of every db should fail")
+	}
+
+	_, err = OpenMulti(names[0], filepath.Join(dir, "x", months[0]))
+	if err == nil {
+		t.Errorf("dbs with the same prefix should not open")
+	}
+}
@@ -5,8 +5,9 @@ It is meant to store a couple of TB
 of 10k-50k json blobs, to take pressure
 of a non-distributed database.
 
-It uses a directory with max. 64k data
-files each 1GB long.  There is one lock file
+It uses a directory with max. 4G data
+files each 1GB long, beyond 64k files the
+refs have the wider v2 form.  There is one lock file
 which is locked exclusively by the
 single writing process.
 
@@ -15,6 +16,10 @@ from multiple goroutines.  If this is the
 writing process, writing from multiple goroutines
 is supported.
 
+Every data file starts with a 16 byte file header
+(magic and format version), files written by older
+versions without file header are still readable.
+
 Blobs are only appended.  They are never
 modified, and individual blobs can not be
 deleted (whole files can be deleted, just
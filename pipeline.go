@@ -0,0 +1,197 @@
+package bobstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// manifestRecheck is how long read-only dbs take unknown typs as unknown
+// before they read the manifest again, e.g. while recovery probes garbage
+const manifestRecheck = time.Second
+
+// codecsLock protects codecs against concurrent registration
+var codecsLock sync.RWMutex
+
+// RegisterCodec registers a codec under its typ,
+// blobs with that typ are then decoded with it.
+func RegisterCodec(codec *Codec) error {
+	if !validTyp(codec.typ) {
+		return fmt.Errorf("codec typ must be 4 upper case letters or digits: %q", codec.typ)
+	}
+	if codec.flags != 0 || codec.choose != nil {
+		return fmt.Errorf("codec %s can not be registered", codec.typ)
+	}
+
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	if old := codecs[codec.typ]; old != nil && old != codec {
+		return fmt.Errorf("codec %s already registered", codec.typ)
+	}
+	codecs[codec.typ] = codec
+
+	return nil
+}
+
+func validTyp(typ string) bool {
+	if len(typ) != 4 {
+		return false
+	}
+	for _, c := range typ {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewPipeline declares and registers a pipeline codec under typ.
+//
+// Encoding applies the stages in order, decoding unwinds them in reverse.
+// The stages must be registered codecs.  Writing with a pipeline codec
+// records its stages in the manifest of the db, so readers can decode
+// the blobs without declaring the pipeline.
+//
+// Encryption must be the last step, so it wraps the pipeline:
+//
+//	p, err := NewPipeline("MJGZ", MinifyJSONCodec(), GZIPCodec())
+//	ref, err := db.WriteWithCodec(b, Encrypted(p, keys))
+func NewPipeline(typ string, stages ...*Codec) (*Codec, error) {
+	for _, stage := range stages {
+		if CodecFor(stage.typ) != stage {
+			return nil, fmt.Errorf("pipeline %s: stage %s is not a registered codec", typ, stage.typ)
+		}
+	}
+
+	codec := pipeline(typ, stages)
+	err := RegisterCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec, nil
+}
+
+func pipeline(typ string, stages []*Codec) *Codec {
+	return &Codec{
+		typ:    typ,
+		stages: stages,
+		encoder: func(src []byte) ([]byte, error) {
+			var err error
+			for _, stage := range stages {
+				src, err = stage.encoder(src)
+				if err != nil {
+					return nil, errors.Wrapf(err, "%s: %s.encode", typ, stage.typ)
+				}
+			}
+			return src, nil
+		},
+		decoder: func(src []byte) ([]byte, error) {
+			var err error
+			for i := len(stages) - 1; i >= 0; i-- {
+				src, err = stages[i].decoder(src)
+				if err != nil {
+					return nil, errors.Wrapf(err, "%s: %s.decode", typ, stages[i].typ)
+				}
+			}
+			return src, nil
+		},
+	}
+}
+
+// recordPipeline adds the stages of a pipeline codec to the manifest.
+// A pipeline recorded with other stages can not be written,
+// readers would decode the blobs with the recorded ones.
+func recordPipeline(db *DB, codec *Codec) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	names := make([]string, len(codec.stages))
+	for i, stage := range codec.stages {
+		names[i] = stage.typ
+	}
+
+	if recorded := db.manifest.Pipelines[codec.typ]; recorded != nil {
+		if strings.Join(recorded, " ") != strings.Join(names, " ") {
+			return errors.Errorf("pipeline %s is recorded with stages %v, not %v", codec.typ, recorded, names)
+		}
+		return nil
+	}
+
+	if db.manifest.Pipelines == nil {
+		db.manifest.Pipelines = make(map[string][]string)
+	}
+	db.manifest.Pipelines[codec.typ] = names
+
+	return xWriteManifest(db)
+}
+
+// CodecFor gives the codec for typ: a registered codec or a pipeline
+// recorded in the manifest of the db, nil if there is none
+func (db *DB) CodecFor(typ string) *Codec {
+	return db.codecFor(typ)
+}
+
+// codecFor gives the codec for typ: a registered codec
+// or a pipeline recorded in the manifest
+func (db *DB) codecFor(typ string) *Codec {
+	codec := CodecFor(typ)
+	if codec != nil {
+		return codec
+	}
+
+	db.lock.Lock()
+	names := db.manifest.Pipelines[typ]
+	if names == nil && db.writer == nil && validTyp(typ) && time.Since(db.manifestChecked) >= manifestRecheck {
+		// the writer may have added the pipeline since we read the manifest
+		db.manifestChecked = time.Now()
+		if xReadManifest(db) == nil {
+			names = db.manifest.Pipelines[typ]
+		}
+	}
+	db.lock.Unlock()
+	if names == nil {
+		return nil
+	}
+
+	stages := make([]*Codec, len(names))
+	for i, name := range names {
+		stages[i] = CodecFor(name)
+		if stages[i] == nil {
+			return nil
+		}
+	}
+
+	return pipeline(typ, stages)
+}
+
+func minifyJSON(src []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	err := json.Compact(&buff, src)
+	if err != nil {
+		return nil, &InvalidJSONError{Err: err}
+	}
+	return buff.Bytes(), nil
+}
+
+func identity(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+var minifyJSONCodec = &Codec{
+	typ:     "MINJ",
+	encoder: minifyJSON,
+	decoder: identity,
+}
+
+// MinifyJSONCodec - removes insignificant whitespace from JSON, meant as pipeline stage.
+// Decoding gives the minified JSON.
+func MinifyJSONCodec() *Codec {
+	return minifyJSONCodec
+}
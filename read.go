@@ -1,7 +1,10 @@
 package bobstore
 
 import (
+	"encoding/binary"
 	"io"
+	"os"
+	"sort"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -9,27 +12,101 @@ import (
 
 // Read the blob at ref
 func (db *DB) Read(ref Ref) ([]byte, error) {
-	f, err := getFile(db, ref.Fno)
+	h, compressed, err := readRaw(db, ref)
 	if err != nil {
 		return nil, err
 	}
 
+	return decode(db, &h, ref, compressed)
+}
+
+// readHeader reads and validates the header of the blob at ref
+func readHeader(db *DB, ref Ref) (*os.File, header, error) {
+	// a read-write db would create the missing file
+	if !fileExists(db, ref.Fno) {
+		return nil, header{}, errors.Wrapf(ErrInvalidRef, "%s: no such file", ref)
+	}
+
+	dbf, err := getDataFile(db, ref.Fno)
+	if err != nil {
+		return nil, header{}, err
+	}
+	if ref.Pos < dbf.start {
+		return nil, header{}, errors.Wrapf(ErrInvalidRef, "%s: inside the file header", ref)
+	}
+	f := dbf.file
+
 	var hb [headerSize]byte
 	_, err = f.ReadAt(hb[:], int64(ref.Pos))
 	if err != nil {
-		return nil, errors.Wrapf(err, "read failed for %s", ref)
+		return nil, header{}, errors.Wrapf(err, "read failed for %s", ref)
+	}
+	h := *(*header)(unsafe.Pointer(&hb[0]))
+	if !h.fits(ref.Pos, db.MaxFileLength) {
+		return nil, header{}, errors.Wrapf(ErrInvalidRef, "%s: record of %d bytes does not fit into a data file", ref, h.recordSize())
 	}
-	h := (*header)(unsafe.Pointer(&hb[0]))
 
-	compressed := make([]byte, h.Compressed)
-	_, err = f.ReadAt(compressed, int64(ref.Pos+headerSize))
+	err = db.validateRef(ref, &h)
 	if err != nil {
-		return nil, errors.Wrapf(err, "read failed for %s", ref)
+		return nil, header{}, err
+	}
+
+	return f, h, nil
+}
+
+// readRaw reads the header and the compressed bytes of the blob at ref
+func readRaw(db *DB, ref Ref) (header, []byte, error) {
+	f, h, err := readHeader(db, ref)
+	if err != nil {
+		return header{}, nil, err
+	}
+
+	body := make([]byte, h.bodySize())
+	_, err = f.ReadAt(body, int64(ref.Pos)+headerSize)
+	if err != nil {
+		return header{}, nil, errors.Wrapf(err, "read failed for %s", ref)
+	}
+
+	compressed, err := h.compressed(body)
+	if err != nil {
+		return header{}, nil, errors.Wrapf(err, "read failed for %s", ref)
+	}
+
+	return h, compressed, nil
+}
+
+// ErrChecksum is returned for records with a checksum that does not match
+var ErrChecksum = errors.New("checksum mismatch")
+
+// compressed verifies the checksum, if any, and returns the compressed bytes of the body
+func (h *header) compressed(body []byte) ([]byte, error) {
+	if uint64(len(body)) < h.bodySize() {
+		return nil, errors.Errorf("record body of %d bytes, the header needs %d", len(body), h.bodySize())
+	}
+
+	end := int(h.MetaLength) + int(h.Compressed)
+	if h.Flags&flagCRC != 0 {
+		if h.checksum(body[:end]) != binary.LittleEndian.Uint32(body[end:end+crcSize]) {
+			return nil, ErrChecksum
+		}
 	}
 
-	codec := codecs[string(h.Typ[:])]
+	return body[h.MetaLength:end], nil
+}
+
+// decode the compressed bytes of the blob at ref
+func decode(db *DB, h *header, ref Ref, compressed []byte) ([]byte, error) {
+	codec := db.codecFor(string(h.Typ[:]))
 	if codec == nil {
-		return nil, errors.Wrapf(err, "unknown codec %s for %s", h.Typ, ref)
+		return nil, errors.Errorf("unknown codec %s for %s", h.Typ, ref)
+	}
+
+	if h.Flags&flagEncrypted != 0 {
+		var err error
+		compressed, err = decrypt(db.KeyProvider, string(h.Typ[:]), compressed)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decrypt %s", ref)
+		}
 	}
 
 	b, err := codec.decoder(compressed)
@@ -42,19 +119,116 @@ func (db *DB) Read(ref Ref) ([]byte, error) {
 
 // Cursor keeps track of the current position and record for iteration.
 type Cursor struct {
-	db         *DB
-	next       Ref
-	ref        Ref
-	typ        string
-	length     uint32
-	compressed uint32
-	err        error
+	db   *DB
+	next Ref
+	ref  Ref
+	h    header
+	err  error
+
+	// compressed bytes of the current blob, if already read
+	raw []byte
+
+	// iterate over [from, to), null to means end of db
+	from Ref
+	to   Ref
+
+	// recovery mode, see SetRecovery
+	skipped  SkipFunc
+	sizeFile *os.File
+	size     int64
+
+	// reverse cursors: offsets of the not yet visited blobs in file next.Fno
+	reverse bool
+	started bool
+	offsets []uint32
+
+	// sequential read-ahead buffer, see SetReadAhead
+	readAhead int
+	buf       []byte
+	bufFno    uint32
+	bufPos    uint32
+
+	// remote cursors read from a Client instead of db
+	remote *remoteCursor
+
+	// chained cursors iterate over the cursors of several dbs one after
+	// the other, the first one is the current one
+	chain []*Cursor
+
+	// prefix of the db in a MultiDB, see QRef
+	prefix string
 }
 
 // Cursor iterates over the db.
 // next is the initial ref, null value means beginning of DB.
 func (db *DB) Cursor(next Ref) *Cursor {
-	return &Cursor{db: db, next: next}
+	return &Cursor{db: db, next: next, from: next}
+}
+
+// CursorRange iterates over the blobs from ref from up to but excluding ref to.
+// A null to means the end of the DB.
+func (db *DB) CursorRange(from, to Ref) *Cursor {
+	return &Cursor{db: db, next: from, from: from, to: to}
+}
+
+// Range gives the range of refs the cursor iterates over
+func (c *Cursor) Range() RefRange {
+	return RefRange{From: c.from, To: c.to}
+}
+
+// ReverseCursor iterates backwards over the blobs in [from, to),
+// starting with the last one.  A null to means the end of the DB,
+// so ReverseCursor(Ref{}, Ref{}) starts with the last blob in the DB.
+//
+// The record format can only be read forwards, so the offsets of the
+// blobs in a data file are collected by reading all their headers
+// when a reverse cursor gets to that file the first time.  They are cached
+// with the open data file for later reverse cursors.
+func (db *DB) ReverseCursor(from, to Ref) *Cursor {
+	return &Cursor{db: db, from: from, to: to, reverse: true}
+}
+
+// SetReadAhead enables a sequential read-ahead buffer of size bytes.
+//
+// Headers, metadata and blobs are then read from the buffer, which is
+// refilled with the next size bytes of the data file when needed.
+// This makes full scans using Blob() or Raw() approach disk bandwidth.
+// 0 disables the buffer.
+func (c *Cursor) SetReadAhead(size int) {
+	c.readAhead = size
+	c.buf = nil
+	for _, sub := range c.chain {
+		sub.SetReadAhead(size)
+	}
+}
+
+// readAt reads len(p) bytes at pos from data file fno, using the read-ahead buffer if any.
+// io.EOF means there were less than len(p) bytes.
+func (c *Cursor) readAt(f *os.File, fno uint32, p []byte, pos uint32) error {
+	if c.readAhead == 0 || len(p) > c.readAhead {
+		_, err := f.ReadAt(p, int64(pos))
+		return err
+	}
+
+	if fno != c.bufFno || pos < c.bufPos || uint64(pos)+uint64(len(p)) > uint64(c.bufPos)+uint64(len(c.buf)) {
+		if cap(c.buf) < c.readAhead {
+			c.buf = make([]byte, c.readAhead)
+		}
+		n, err := f.ReadAt(c.buf[:c.readAhead], int64(pos))
+		if err != nil && err != io.EOF {
+			c.buf = c.buf[:0]
+			return err
+		}
+		c.buf = c.buf[:n]
+		c.bufFno = fno
+		c.bufPos = pos
+		if n < len(p) {
+			return io.EOF
+		}
+	}
+
+	copy(p, c.buf[pos-c.bufPos:])
+	return nil
 }
 
 // Next advances to the next blob.
@@ -69,17 +243,41 @@ func (db *DB) Cursor(next Ref) *Cursor {
 // false, only Error() has a defined result.
 //
 func (c *Cursor) Next() bool {
-	f, err := getFile(c.db, c.next.Fno)
+	if c.remote != nil {
+		return c.remote.next(c)
+	}
+	if c.chain != nil {
+		return c.nextChained()
+	}
+	if c.reverse {
+		return c.prev()
+	}
+
+	if !c.to.IsZero() && !c.next.Less(c.to) {
+		return false
+	}
+
+	dbf, err := getDataFile(c.db, c.next.Fno)
 	if err != nil {
 		c.err = err
 		return false
 	}
+	f := dbf.file
+
+	// skip the file header
+	if c.next.Pos < dbf.start {
+		c.next.Pos = dbf.start
+		if !c.to.IsZero() && !c.next.Less(c.to) {
+			return false
+		}
+	}
 
 	var hb [headerSize]byte
-	_, err = f.ReadAt(hb[:], int64(c.next.Pos))
+	err = c.readAt(f, c.next.Fno, hb[:], c.next.Pos)
 	// handle switch to next file
 	if err == io.EOF {
-		if _, err2 := getFile(c.db, c.next.Fno+1); err2 != nil {
+		// getFile would create the next file if opened read-write
+		if c.next.Fno == MaxNumberFilesV2 || !fileExists(c.db, c.next.Fno+1) {
 			return false
 		}
 		c.next.Fno++
@@ -90,37 +288,300 @@ func (c *Cursor) Next() bool {
 		c.err = err
 		return false
 	}
-	h := (*header)(unsafe.Pointer(&hb[0]))
 
-	c.ref = Ref{Fno: c.next.Fno, Pos: c.next.Pos}
-	c.typ = string(h.Typ[:])
-	c.length = h.Length
-	c.compressed = h.Compressed
+	if c.skipped != nil {
+		ok, err := c.valid(f, c.next.Fno, (*header)(unsafe.Pointer(&hb[0])), c.next.Pos)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if !ok {
+			return c.resync(f)
+		}
+	}
+
+	c.h = *(*header)(unsafe.Pointer(&hb[0]))
+	if !c.h.fits(c.next.Pos, c.db.MaxFileLength) {
+		c.err = errors.Errorf("corrupt header at %s: record of %d bytes does not fit into a data file", c.next, c.h.recordSize())
+		return false
+	}
+	c.ref = c.db.extendedRef(c.next.Fno, c.next.Pos, &c.h)
+	c.raw = nil
 
-	c.next.Pos = (c.next.Pos + headerSize + h.Compressed + 7) & 0xFFFFFFF8
+	c.next.Pos += uint32(c.h.recordSize())
 
 	return true
 }
 
+// prev is Next for reverse cursors
+func (c *Cursor) prev() bool {
+	for len(c.offsets) == 0 {
+		// the end of the file, whatever its length
+		end := ^uint32(0)
+		first := !c.started
+		if first {
+			c.started = true
+			if c.to.IsZero() {
+				fnos, err := dataFiles(c.db)
+				if err != nil {
+					c.err = err
+					return false
+				}
+				if len(fnos) == 0 {
+					return false
+				}
+				c.next.Fno = fnos[len(fnos)-1]
+			} else {
+				c.next.Fno = c.to.Fno
+				end = c.to.Pos
+			}
+		} else {
+			if c.next.Fno <= c.from.Fno {
+				return false
+			}
+			c.next.Fno--
+		}
+
+		if !fileExists(c.db, c.next.Fno) {
+			if first {
+				// to may be the write position in a file not created yet
+				continue
+			}
+			// deleted file, there is nothing before it
+			return false
+		}
+
+		var start uint32
+		if c.next.Fno == c.from.Fno {
+			start = c.from.Pos
+		}
+		offsets, err := recordOffsets(c.db, c.next.Fno, start, end)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		c.offsets = offsets
+	}
+
+	pos := c.offsets[len(c.offsets)-1]
+	c.offsets = c.offsets[:len(c.offsets)-1]
+
+	f, err := getFile(c.db, c.next.Fno)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	var hb [headerSize]byte
+	err = c.readAt(f, c.next.Fno, hb[:], pos)
+	if err != nil {
+		c.err = errors.Wrapf(err, "read failed for %s", Ref{Fno: c.next.Fno, Pos: pos})
+		return false
+	}
+
+	c.h = *(*header)(unsafe.Pointer(&hb[0]))
+	c.ref = c.db.extendedRef(c.next.Fno, pos, &c.h)
+	c.raw = nil
+
+	return true
+}
+
+// recordOffsets gives the offsets of the blobs in data file fno
+// starting at pos start and before pos end.
+//
+// The offsets are found by reading the headers and cached with the data file,
+// later calls only read the headers of records written since.
+func recordOffsets(db *DB, fno uint32, start, end uint32) ([]uint32, error) {
+	dbf, err := getDataFile(db, fno)
+	if err != nil {
+		return nil, err
+	}
+
+	dbf.olock.Lock()
+	defer dbf.olock.Unlock()
+
+	if dbf.offsetsEnd < end {
+		err = readOffsets(db, fno, dbf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	i := sort.Search(len(dbf.offsets), func(i int) bool { return dbf.offsets[i] >= start })
+	j := sort.Search(len(dbf.offsets), func(i int) bool { return dbf.offsets[i] >= end })
+	// the cache may grow behind the returned offsets
+	return dbf.offsets[i:j:j], nil
+}
+
+// readOffsets adds the offsets of the complete records after dbf.offsetsEnd
+// to the cache.  olock is acquired.
+func readOffsets(db *DB, fno uint32, dbf *dbFile) error {
+	size, err := dataFileSize(db, fno)
+	if err != nil {
+		return err
+	}
+	// records after the committed position may not be written yet
+	if db.writer != nil {
+		if committed := committedPosition(db); committed.Fno == fno && int64(committed.Pos) < size {
+			size = int64(committed.Pos)
+		}
+	}
+
+	pos := dbf.offsetsEnd
+	if pos < dbf.start {
+		pos = dbf.start
+	}
+
+	var hb [headerSize]byte
+	for int64(pos)+headerSize <= size {
+		_, err = dbf.file.ReadAt(hb[:], int64(pos))
+		if err != nil {
+			return errors.Wrapf(err, "read failed for %s", Ref{Fno: fno, Pos: pos})
+		}
+		h := (*header)(unsafe.Pointer(&hb[0]))
+		if !validTyp(string(h.Typ[:])) || !h.fits(pos, db.MaxFileLength) || int64(pos)+int64(h.recordSize()) > size {
+			break
+		}
+
+		dbf.offsets = append(dbf.offsets, pos)
+		pos += uint32(h.recordSize())
+	}
+	dbf.offsetsEnd = pos
+
+	return nil
+}
+
+// nextChained advances the current cursor of the chain
+func (c *Cursor) nextChained() bool {
+	for len(c.chain) > 0 {
+		sub := c.chain[0]
+		if sub.Next() {
+			c.ref = sub.ref
+			c.h = sub.h
+			c.prefix = sub.prefix
+			return true
+		}
+		if sub.err != nil {
+			c.err = sub.err
+			return false
+		}
+		c.chain = c.chain[1:]
+	}
+	return false
+}
+
 // Ref returns the current ref.
 func (c *Cursor) Ref() Ref {
 	return c.ref
 }
 
+// QRef returns the current ref qualified with the prefix of its db,
+// without prefix if the cursor is not from a MultiDB.
+func (c *Cursor) QRef() QRef {
+	return QRef{Prefix: c.prefix, Ref: c.ref}
+}
+
 // Typ returns the typ of the current blob.
 // One of SNAP, GZIP, NONE.
 func (c *Cursor) Typ() string {
-	return c.typ
+	return string(c.h.Typ[:])
 }
 
 // Length returns the length of the current blob.
 func (c *Cursor) Length() uint32 {
-	return c.length
+	return c.h.Length
 }
 
 // Compressed returns the compressed length of the current blob.
 func (c *Cursor) Compressed() uint32 {
-	return c.compressed
+	return c.h.Compressed
+}
+
+// JSON is true if the current blob was validated as JSON when it was written.
+func (c *Cursor) JSON() bool {
+	return c.h.Flags&flagJSON != 0
+}
+
+// Encrypted is true if the current blob is encrypted, see Encrypted.
+func (c *Cursor) Encrypted() bool {
+	return c.h.Flags&flagEncrypted != 0
+}
+
+// Meta returns the metadata of the current blob, nil if it has none.
+// The blob itself is not read or decoded.
+func (c *Cursor) Meta() (Meta, error) {
+	if c.remote != nil {
+		return c.remote.line.Meta, nil
+	}
+	if c.chain != nil {
+		return c.chain[0].Meta()
+	}
+	if c.h.MetaLength == 0 {
+		return nil, nil
+	}
+
+	f, err := getFile(c.db, c.ref.Fno)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, c.h.MetaLength)
+	err = c.readAt(f, c.ref.Fno, b, c.ref.Pos+headerSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read meta failed for %s", c.ref)
+	}
+
+	return decodeMeta(b)
+}
+
+// Raw returns the compressed bytes of the current blob.
+// The result must not be modified.  Remote cursors only have the decoded blob.
+func (c *Cursor) Raw() ([]byte, error) {
+	if c.remote != nil {
+		return nil, errors.Errorf("no raw bytes for %s from a remote cursor", c.ref)
+	}
+	if c.chain != nil {
+		return c.chain[0].Raw()
+	}
+	if c.raw != nil {
+		return c.raw, nil
+	}
+
+	f, err := getFile(c.db, c.ref.Fno)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, c.h.bodySize())
+	err = c.readAt(f, c.ref.Fno, body, c.ref.Pos+headerSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read failed for %s", c.ref)
+	}
+
+	raw, err := c.h.compressed(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read failed for %s", c.ref)
+	}
+
+	c.raw = raw
+	return raw, nil
+}
+
+// Blob returns the decoded current blob,
+// without looking up the header again like Read(c.Ref()).
+func (c *Cursor) Blob() ([]byte, error) {
+	if c.remote != nil {
+		return c.remote.line.Blob, nil
+	}
+	if c.chain != nil {
+		return c.chain[0].Blob()
+	}
+	raw, err := c.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(c.db, &c.h, c.ref, raw)
 }
 
 // Err gives the error that caused Next() to return false, if any.
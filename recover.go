@@ -0,0 +1,112 @@
+package bobstore
+
+import (
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// SkipFunc is called by a recovering cursor for a region of a data file
+// that was skipped because there was no valid record.  start is the
+// position of the invalid header, end is the position of the next valid
+// record or the end of the file.
+type SkipFunc func(fno uint32, start, end uint32)
+
+// SetRecovery switches the cursor to recovery mode for salvaging damaged data files.
+//
+// Every header is validated: the codec must be known, the flags must be
+// understood and the record must fit into the file.  Records with a
+// checksum (see DB.Checksums) are verified as well.  If a header is invalid,
+// the cursor scans forward in steps of 8 bytes for the next valid header
+// and reports the skipped region to skipped.
+//
+// Recovery only works for cursors iterating forward.
+func (c *Cursor) SetRecovery(skipped SkipFunc) {
+	c.skipped = skipped
+}
+
+// fileSize gives the current size of data file fno
+func (c *Cursor) fileSize(f *os.File, fno uint32) (int64, error) {
+	if c.sizeFile != f {
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, errors.Wrapf(err, "stat data file %05d", fno)
+		}
+		c.sizeFile = f
+		c.size = fi.Size()
+	}
+	return c.size, nil
+}
+
+// valid checks the header at pos
+func (c *Cursor) valid(f *os.File, fno uint32, h *header, pos uint32) (bool, error) {
+	if c.db.codecFor(string(h.Typ[:])) == nil || h.Flags&^knownFlags != 0 || !h.fits(pos, c.db.MaxFileLength) {
+		return false, nil
+	}
+
+	end := int64(pos) + headerSize + int64(h.bodySize())
+	size, err := c.fileSize(f, fno)
+	if err == nil && end > size {
+		// the file may have grown since
+		c.sizeFile = nil
+		size, err = c.fileSize(f, fno)
+	}
+	if err != nil {
+		return false, err
+	}
+	if end > size {
+		return false, nil
+	}
+
+	if h.Flags&flagCRC != 0 {
+		body := make([]byte, h.bodySize())
+		err = c.readAt(f, fno, body, pos+headerSize)
+		if err != nil {
+			return false, errors.Wrapf(err, "read failed for %s", Ref{Fno: fno, Pos: pos})
+		}
+		if _, err = h.compressed(body); err != nil {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// resync scans forward for the next valid header after an invalid one at c.next
+func (c *Cursor) resync(f *os.File) bool {
+	fno := c.next.Fno
+	start := c.next.Pos
+
+	var hb [headerSize]byte
+	for pos := start + 8; ; pos += 8 {
+		err := c.readAt(f, fno, hb[:], pos)
+		if err == io.EOF {
+			size, err := c.fileSize(f, fno)
+			if err != nil {
+				c.err = err
+				return false
+			}
+			c.skipped(fno, start, uint32(size))
+			// Next switches to the next file
+			c.next.Pos = uint32(size)
+			return c.Next()
+		}
+		if err != nil {
+			c.err = errors.Wrapf(err, "read failed for %s", Ref{Fno: fno, Pos: pos})
+			return false
+		}
+
+		ok, err := c.valid(f, fno, (*header)(unsafe.Pointer(&hb[0])), pos)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if ok {
+			c.skipped(fno, start, pos)
+			c.next.Pos = pos
+			return c.Next()
+		}
+	}
+}
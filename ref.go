@@ -1,59 +1,338 @@
 package bobstore
 
 import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"regexp"
 	"strconv"
+	"unsafe"
 
 	"github.com/pkg/errors"
 )
 
 // Ref is a reference to a storage file and position
 // the string representation is fixed: 5 digits : 8 hex digits ==> 14 characters in all
+//
+// With DB.ExtendedRefs, refs returned by Write and Cursor are extended refs:
+// they also carry the id of the store and a check nibble of the record header,
+// so DB.Read can reject refs from another store or into the middle of a blob.
+// The extended string representation is 4 hex digits - 14 characters - 1 hex digit,
+// e.g. 1f2e-00003:00000666-a.
+//
+// v2 refs have file numbers beyond 16 bit, these used to be reserved bits.
+// Their string representation has 10 digits for the file number,
+// e.g. 0000065536:00000010 or 1f2e-0000065536:00000010-a.
+// Refs with 16 bit file numbers keep the 5 digit form.
 type Ref struct {
-	// Fno
-	Fno uint16
-	// reserved
-	_ uint16
+	// Fno, 16 bit for v1 refs
+	Fno uint32
 	// Position within the file
 	Pos uint32
+	// Store is the id of the store, 0 for plain refs
+	Store uint16
+	// Check is the check nibble of the record header, only valid if Store is not 0
+	Check uint8
 }
 
 const srefLength = 14
 
+// xrefLength is the length of the extended string representation
+const xrefLength = 21
+
+// lengths of the string representations of v2 refs
+const (
+	swrefLength = 19
+	xwrefLength = 26
+)
+
+// maxV1Fno is the largest file number of v1 refs
+const maxV1Fno = 0xFFFF
+
 func (ref Ref) String() string {
+	if ref.Fno > maxV1Fno {
+		if ref.Store != 0 {
+			return fmt.Sprintf("%04x-%010d:%08x-%x", ref.Store, ref.Fno, ref.Pos, ref.Check)
+		}
+		return fmt.Sprintf("%010d:%08x", ref.Fno, ref.Pos)
+	}
+	if ref.Store != 0 {
+		return fmt.Sprintf("%04x-%05d:%08x-%x", ref.Store, ref.Fno, ref.Pos, ref.Check)
+	}
 	return fmt.Sprintf("%05d:%08x", ref.Fno, ref.Pos)
 }
 
-var parseRefRe = regexp.MustCompile(`^\d{5}:[0-9a-fA-F]{8}$`)
+// Compare orders refs by file number and position, which is the order
+// they were written in.  It returns -1, 0 or +1 if ref is before, the same as
+// or after other.  Store and check of extended refs are not compared.
+func (ref Ref) Compare(other Ref) int {
+	switch {
+	case ref.Fno < other.Fno:
+		return -1
+	case ref.Fno > other.Fno:
+		return 1
+	case ref.Pos < other.Pos:
+		return -1
+	case ref.Pos > other.Pos:
+		return 1
+	}
+	return 0
+}
+
+// Less is true if ref was written before other, see Compare
+func (ref Ref) Less(other Ref) bool {
+	return ref.Compare(other) < 0
+}
 
-// ParseRef parses a refs string representation
+// IsZero is true for the null value 00000:00000000, the beginning of the DB
+func (ref Ref) IsZero() bool {
+	return ref.Fno == 0 && ref.Pos == 0
+}
+
+// RefRange is the range of refs from From up to but excluding To.
+// A null To means unbounded.
+type RefRange struct {
+	From Ref
+	To   Ref
+}
+
+// Contains is true if ref is in the range
+func (r RefRange) Contains(ref Ref) bool {
+	return !ref.Less(r.From) && (r.To.IsZero() || ref.Less(r.To))
+}
+
+func (r RefRange) String() string {
+	return fmt.Sprintf("[%s, %s)", r.From, r.To)
+}
+
+// Distance gives the distance in bytes from a to b, negative if b is before a.
+// Data files are counted with their maximum length MaxFileLength.
+func (db *DB) Distance(a, b Ref) int64 {
+	return (int64(b.Fno)-int64(a.Fno))*int64(db.MaxFileLength) + int64(b.Pos) - int64(a.Pos)
+}
+
+var parseRefRe = regexp.MustCompile(`^(\d{5}|\d{10}):[0-9a-fA-F]{8}$`)
+
+var parseXRefRe = regexp.MustCompile(`^[0-9a-fA-F]{4}-(\d{5}|\d{10}):[0-9a-fA-F]{8}-[0-9a-fA-F]$`)
+
+// ParseRef parses a refs string representation, plain or extended, v1 or v2.
+// Every ref has exactly one string representation, so v2 forms
+// of refs with 16 bit file numbers are rejected.
 func ParseRef(s string) (Ref, error) {
 	var ref Ref
 
+	if parseXRefRe.MatchString(s) {
+		store, _ := strconv.ParseUint(s[0:4], 16, 16)
+		check, _ := strconv.ParseUint(s[len(s)-1:], 16, 8)
+		if store == 0 {
+			return ref, fmt.Errorf("can not parse Ref: store 0 %s", s)
+		}
+
+		var err error
+		ref, err = ParseRef(s[5 : len(s)-2])
+		if err != nil {
+			return ref, err
+		}
+		ref.Store = uint16(store)
+		ref.Check = uint8(check)
+		return ref, nil
+	}
+
 	if !parseRefRe.MatchString(s) {
 		return ref, fmt.Errorf("can not parse Ref: %s", s)
 	}
 
-	fno, err := strconv.ParseUint(s[0:5], 10, 16)
+	colon := len(s) - 9
+	fno, err := strconv.ParseUint(s[:colon], 10, 32)
 	if err != nil {
 		return ref, errors.Wrapf(err, "parse ref fno %s", s)
 	}
+	if (colon == 5) != (fno <= maxV1Fno) {
+		return ref, fmt.Errorf("can not parse Ref: file number %d in the wrong form %s", fno, s)
+	}
 
-	pos, err := strconv.ParseUint(s[6:], 16, 32)
+	pos, err := strconv.ParseUint(s[colon+1:], 16, 32)
 	if err != nil {
 		return ref, errors.Wrapf(err, "parse ref pos %s", s)
 	}
 
-	ref.Fno = uint16(fno)
+	ref.Fno = uint32(fno)
 	ref.Pos = uint32(pos)
 
 	return ref, nil
 }
 
+// ErrInvalidRef is returned by DB.Read for refs that do not point to a blob in the DB
+var ErrInvalidRef = errors.New("invalid ref")
+
+// checkNibble of the record header for extended refs
+func checkNibble(h *header) uint8 {
+	return uint8(crc32.Checksum((*headerBytes)(unsafe.Pointer(h))[:], crcTable) & 0xF)
+}
+
+// extendedRef gives the ref for the record with header h at fno and pos,
+// an extended ref if the db gives them out
+func (db *DB) extendedRef(fno uint32, pos uint32, h *header) Ref {
+	ref := Ref{Fno: fno, Pos: pos}
+	if db.ExtendedRefs && db.storeID != 0 {
+		ref.Store = db.storeID
+		ref.Check = checkNibble(h)
+	}
+	return ref
+}
+
+// validateRef rejects refs that can not point to a blob in the db.
+// h is the header found at the ref.
+func (db *DB) validateRef(ref Ref, h *header) error {
+	if ref.Pos&7 != 0 {
+		return errors.Wrapf(ErrInvalidRef, "%s: unaligned", ref)
+	}
+	if ref.Store == 0 {
+		return nil
+	}
+	if db.storeID != 0 && ref.Store != db.storeID {
+		return errors.Wrapf(ErrInvalidRef, "%s: ref for store %04x, this is %04x", ref, ref.Store, db.storeID)
+	}
+	if ref.Check != checkNibble(h) {
+		return errors.Wrapf(ErrInvalidRef, "%s: check mismatch", ref)
+	}
+	// the nibble matches 1 in 16 positions in the middle of a blob
+	if db.codecFor(string(h.Typ[:])) == nil || h.Flags&^knownFlags != 0 {
+		return errors.Wrapf(ErrInvalidRef, "%s: no record header", ref)
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler, the text is the string representation
+func (ref Ref) MarshalText() ([]byte, error) {
+	return []byte(ref.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (ref *Ref) UnmarshalText(text []byte) error {
+	r, err := ParseRef(string(text))
+	if err != nil {
+		return err
+	}
+	*ref = r
+	return nil
+}
+
+// binary representation: fno (2 bytes) and pos (4 bytes), big endian
+// so the binary representations sort like the refs.
+// extended refs are followed by store (2 bytes) and check (1 byte)
+const brefLength = 6
+
+const bxrefLength = 9
+
+// v2 refs: fno (4 bytes), pos (4 bytes), store (2 bytes, 0 for plain refs)
+// and check (1 byte)
+const bwrefLength = 11
+
+// MarshalBinary implements encoding.BinaryMarshaler with a compact 6 byte form,
+// 9 bytes for extended refs and 11 bytes for v2 refs
+func (ref Ref) MarshalBinary() ([]byte, error) {
+	if ref.Fno > maxV1Fno {
+		b := make([]byte, bwrefLength)
+		binary.BigEndian.PutUint32(b, ref.Fno)
+		binary.BigEndian.PutUint32(b[4:], ref.Pos)
+		binary.BigEndian.PutUint16(b[8:], ref.Store)
+		b[10] = ref.Check
+		return b, nil
+	}
+
+	b := make([]byte, brefLength, bxrefLength)
+	binary.BigEndian.PutUint16(b, uint16(ref.Fno))
+	binary.BigEndian.PutUint32(b[2:], ref.Pos)
+	if ref.Store != 0 {
+		b = b[:bxrefLength]
+		binary.BigEndian.PutUint16(b[6:], ref.Store)
+		b[8] = ref.Check
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// It also accepts an 8 byte form: fno (2 bytes), 2 zero bytes, pos (4 bytes)
+func (ref *Ref) UnmarshalBinary(b []byte) error {
+	*ref = Ref{}
+	switch len(b) {
+	case brefLength:
+		ref.Fno = uint32(binary.BigEndian.Uint16(b))
+		ref.Pos = binary.BigEndian.Uint32(b[2:])
+	case bxrefLength:
+		ref.Fno = uint32(binary.BigEndian.Uint16(b))
+		ref.Pos = binary.BigEndian.Uint32(b[2:])
+		ref.Store = binary.BigEndian.Uint16(b[6:])
+		ref.Check = b[8] & 0xF
+		if ref.Store == 0 {
+			return errors.New("can not unmarshal Ref: store 0")
+		}
+	case 8:
+		if b[2] != 0 || b[3] != 0 {
+			return fmt.Errorf("can not unmarshal Ref: reserved bytes %x", b[2:4])
+		}
+		ref.Fno = uint32(binary.BigEndian.Uint16(b))
+		ref.Pos = binary.BigEndian.Uint32(b[4:])
+	case bwrefLength:
+		ref.Fno = binary.BigEndian.Uint32(b)
+		ref.Pos = binary.BigEndian.Uint32(b[4:])
+		ref.Store = binary.BigEndian.Uint16(b[8:])
+		if ref.Store != 0 {
+			ref.Check = b[10] & 0xF
+		}
+		if ref.Fno <= maxV1Fno {
+			return fmt.Errorf("can not unmarshal Ref: file number %d in the v2 form", ref.Fno)
+		}
+	default:
+		return fmt.Errorf("can not unmarshal Ref from %d bytes", len(b))
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, refs are json strings
+func (ref Ref) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ref.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (ref *Ref) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.Wrap(err, "can not unmarshal Ref")
+	}
+	return ref.UnmarshalText([]byte(s))
+}
+
+// Value implements driver.Valuer, refs are stored as strings
+func (ref Ref) Value() (driver.Value, error) {
+	return ref.String(), nil
+}
+
+// Scan implements sql.Scanner for string and []byte columns.
+// []byte columns may hold the string or the binary representation.
+func (ref *Ref) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return ref.UnmarshalText([]byte(src))
+	case []byte:
+		switch len(src) {
+		case srefLength, xrefLength, swrefLength, xwrefLength:
+			return ref.UnmarshalText(src)
+		}
+		return ref.UnmarshalBinary(src)
+	default:
+		return fmt.Errorf("can not scan Ref from %T", src)
+	}
+}
+
 func readWriterRef(db *DB) error {
-	buff := make([]byte, srefLength)
+	// v1 or v2 ref, the file has no newline
+	buff := make([]byte, swrefLength)
 	n, err := db.writer.ReadAt(buff, 0)
 	if err == io.EOF && n == 0 {
 		// if n == 0 and EOF --> empty file
@@ -61,14 +340,14 @@ func readWriterRef(db *DB) error {
 		// log.Printf("readWriterRef: EOF n=%d", n)
 		return nil
 	}
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return err
 	}
-	if n < srefLength {
+	if n != srefLength && n != swrefLength {
 		return fmt.Errorf("incomplete ref %d", n)
 	}
 
-	ref, err := ParseRef(string(buff))
+	ref, err := ParseRef(string(buff[:n]))
 	if err != nil {
 		return err
 	}
@@ -86,7 +365,7 @@ func writeWriterRef(db *DB) error {
 		return err
 	}
 
-	err = db.writer.Truncate(srefLength)
+	err = db.writer.Truncate(int64(len(sref)))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,407 @@
+package bobstore
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// Ref implements the usual marshalling interfaces
+var (
+	_ encoding.TextMarshaler     = Ref{}
+	_ encoding.TextUnmarshaler   = &Ref{}
+	_ encoding.BinaryMarshaler   = Ref{}
+	_ encoding.BinaryUnmarshaler = &Ref{}
+	_ json.Marshaler             = Ref{}
+	_ json.Unmarshaler           = &Ref{}
+	_ driver.Valuer              = Ref{}
+	_ sql.Scanner                = &Ref{}
+)
+
+func Test_RefJSON(t *testing.T) {
+	in := struct {
+		Ref Ref `json:"ref"`
+	}{Ref{Fno: 7, Pos: 0xabc0}}
+
+	b, err := json.Marshal(in)
+	if err != nil || string(b) != `{"ref":"00007:0000abc0"}` {
+		t.Errorf("json.Marshal: %s %v", b, err)
+	}
+
+	out := in
+	out.Ref = Ref{}
+	err = json.Unmarshal(b, &out)
+	if err != nil || out.Ref != in.Ref {
+		t.Errorf("json.Unmarshal: %s %v", out.Ref, err)
+	}
+
+	err = json.Unmarshal([]byte(`{"ref":"7:abc0"}`), &out)
+	if err == nil {
+		t.Errorf("json.Unmarshal of an invalid ref should fail")
+	}
+}
+
+func Test_RefSQL(t *testing.T) {
+	ref := Ref{Fno: 12, Pos: 0x1000}
+	v, err := ref.Value()
+	if err != nil || v != "00012:00001000" {
+		t.Errorf("Value: %v %v", v, err)
+	}
+
+	bin, _ := ref.MarshalBinary()
+	for _, src := range []interface{}{"00012:00001000", []byte("00012:00001000"), bin} {
+		var r Ref
+		err = r.Scan(src)
+		if err != nil || r != ref {
+			t.Errorf("Scan %#v: %s %v", src, r, err)
+		}
+	}
+
+	var r Ref
+	if r.Scan(int64(12)) == nil {
+		t.Errorf("Scan of an int64 should fail")
+	}
+}
+
+func Fuzz_ParseRef(f *testing.F) {
+	f.Add("00000:00000000")
+	f.Add("00003:00000666")
+	f.Add("65535:FFFFFFF8")
+	f.Add("99999:00000000")
+	f.Add("0000:000000000")
+	f.Add("1f2e-00003:00000666-a")
+	f.Add("0000-00003:00000666-a")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		ref, err := ParseRef(s)
+		if err != nil {
+			return
+		}
+
+		bin, _ := ref.MarshalBinary()
+		var rb Ref
+		err = rb.UnmarshalBinary(bin)
+		if err != nil || rb != ref {
+			t.Errorf("binary round trip of %q: %s %v", s, rb, err)
+		}
+
+		var r Ref
+		err = r.UnmarshalText([]byte(ref.String()))
+		if err != nil || r != ref {
+			t.Errorf("text round trip of %q: %s %v", s, r, err)
+		}
+
+		b, _ := json.Marshal(ref)
+		r = Ref{}
+		err = json.Unmarshal(b, &r)
+		if err != nil || r != ref {
+			t.Errorf("json round trip of %q: %s %v", s, r, err)
+		}
+	})
+}
+
+func Fuzz_RefBinary(f *testing.F) {
+	f.Add(uint32(0), uint32(0))
+	f.Add(uint32(3), uint32(0x666))
+	f.Add(uint32(0xFFFF), uint32(0xFFFFFFFF))
+	f.Add(uint32(0x10000), uint32(0x10))
+	f.Add(uint32(0xFFFFFFFF), uint32(0xFFFFFFFF))
+
+	f.Fuzz(func(t *testing.T, fno uint32, pos uint32) {
+		ref := Ref{Fno: fno, Pos: pos}
+
+		b, err := ref.MarshalBinary()
+		want := brefLength
+		if fno > maxV1Fno {
+			want = bwrefLength
+		}
+		if err != nil || len(b) != want {
+			t.Fatalf("MarshalBinary %s: %x %v", ref, b, err)
+		}
+
+		var r Ref
+		err = r.UnmarshalBinary(b)
+		if err != nil || r != ref {
+			t.Errorf("binary round trip of %s: %s %v", ref, r, err)
+		}
+
+		// the binary form agrees with the string form
+		parsed, err := ParseRef(ref.String())
+		if err != nil || parsed != r {
+			t.Errorf("ParseRef of %s: %s %v", ref, parsed, err)
+		}
+
+		if fno > maxV1Fno {
+			return
+		}
+		wide := append(append(append([]byte{}, b[:2]...), 0, 0), b[2:]...)
+		r = Ref{}
+		err = r.UnmarshalBinary(wide)
+		if err != nil || r != ref {
+			t.Errorf("8 byte round trip of %s: %s %v", ref, r, err)
+		}
+	})
+}
+
+func Test_RefV2(t *testing.T) {
+	for _, tc := range []struct {
+		ref Ref
+		s   string
+	}{
+		{Ref{Fno: 0xFFFF, Pos: 0x10}, "65535:00000010"},
+		{Ref{Fno: 0x10000, Pos: 0x10}, "0000065536:00000010"},
+		{Ref{Fno: 0x10000, Pos: 0x10, Store: 0x1f2e, Check: 0xa}, "1f2e-0000065536:00000010-a"},
+		{Ref{Fno: 0xFFFFFFFF, Pos: 0xFFFFFFF8}, "4294967295:fffffff8"},
+	} {
+		if tc.ref.String() != tc.s {
+			t.Errorf("%#v should be %s, but: %s", tc.ref, tc.s, tc.ref)
+		}
+		ref, err := ParseRef(tc.s)
+		if err != nil || ref != tc.ref {
+			t.Errorf("ParseRef %s: %#v %v", tc.s, ref, err)
+		}
+
+		var r Ref
+		err = r.Scan([]byte(tc.s))
+		if err != nil || r != tc.ref {
+			t.Errorf("Scan %s: %#v %v", tc.s, r, err)
+		}
+	}
+
+	// one string per ref
+	for _, s := range []string{"0000065535:00000010", "70000:00000010", "4294967296:00000000"} {
+		if _, err := ParseRef(s); err == nil {
+			t.Errorf("ParseRef %s should fail", s)
+		}
+	}
+}
+
+func Test_InvalidRef(t *testing.T) {
+	db1, plain := openScanTestDB(t, 1)
+	defer closeScanTestDB(db1)
+	db2, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(db2)
+
+	if plain[0].Store != 0 || len(plain[0].String()) != srefLength {
+		t.Errorf("write should return a plain ref by default: %s", plain[0])
+	}
+
+	db1.ExtendedRefs = true
+	db2.ExtendedRefs = true
+	db1.MaxFileLength = MaxFileLength
+	db2.MaxFileLength = MaxFileLength
+	var refs1, refs2 []Ref
+	for i := 1; i < 20; i++ {
+		b := []byte(fmt.Sprintf("blob number %d", i))
+		if i > 1 {
+			// longer blobs with varied content for the positions inside them
+			b = make([]byte, 64*i)
+			rand.Read(b)
+		}
+		ref, err := db1.Write(b)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs1 = append(refs1, ref)
+		ref, err = db2.Write(b)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs2 = append(refs2, ref)
+	}
+
+	ref := refs1[0]
+	if ref.Store == 0 || len(ref.String()) != xrefLength {
+		t.Fatalf("write should return an extended ref: %s", ref)
+	}
+	parsed, err := ParseRef(ref.String())
+	if err != nil || parsed != ref {
+		t.Errorf("ParseRef of extended ref %s: %s %v", ref, parsed, err)
+	}
+
+	// plain refs are not validated
+	b, err := db1.Read(Ref{Fno: ref.Fno, Pos: ref.Pos})
+	if err != nil || string(b) != "blob number 1" {
+		t.Errorf("read plain ref: %q %v", b, err)
+	}
+
+	// the same position in another store
+	if refs2[1].Store == ref.Store {
+		t.Skipf("both stores have id %04x", ref.Store)
+	}
+	_, err = db2.Read(ref)
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("read of a ref from another store should fail with ErrInvalidRef, but: %v", err)
+	}
+
+	// every position in the middle of a blob, with every check nibble
+	for i, ref := range refs1[:len(refs1)-1] {
+		for pos := ref.Pos + 8; pos < refs1[i+1].Pos; pos += 8 {
+			for check := uint8(0); check < 16; check++ {
+				bad := Ref{Fno: ref.Fno, Pos: pos, Store: ref.Store, Check: check}
+				_, err = db1.Read(bad)
+				if errors.Cause(err) != ErrInvalidRef {
+					t.Fatalf("read of %s should fail with ErrInvalidRef, but: %v", bad, err)
+				}
+			}
+		}
+	}
+	// positions in the file header
+	for _, pos := range []uint32{0, 8} {
+		for _, r := range []Ref{{Pos: pos}, {Pos: pos, Store: ref.Store, Check: ref.Check}} {
+			_, err = db1.Read(r)
+			if errors.Cause(err) != ErrInvalidRef {
+				t.Errorf("read of %s should fail with ErrInvalidRef, but: %v", r, err)
+			}
+		}
+	}
+	bad := ref
+	bad.Check = (ref.Check + 1) & 0xF
+	_, err = db1.Read(bad)
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("read of %s should fail with ErrInvalidRef, but: %v", bad, err)
+	}
+}
+
+func Test_RefOrder(t *testing.T) {
+	a := Ref{Fno: 1, Pos: 0x100}
+	b := Ref{Fno: 1, Pos: 0x200}
+	c := Ref{Fno: 2, Pos: 0x10}
+
+	if a.Compare(b) != -1 || b.Compare(a) != 1 || a.Compare(a) != 0 || !b.Less(c) || c.Less(a) {
+		t.Errorf("refs should be ordered %s < %s < %s", a, b, c)
+	}
+	xa := a
+	xa.Store, xa.Check = 0x1f2e, 3
+	if xa.Compare(a) != 0 {
+		t.Errorf("store and check should not be compared: %s %s", xa, a)
+	}
+	if !(Ref{}).IsZero() || a.IsZero() {
+		t.Errorf("only the null ref should be zero")
+	}
+
+	r := RefRange{From: a, To: c}
+	if !r.Contains(a) || !r.Contains(b) || r.Contains(c) || r.Contains(Ref{}) {
+		t.Errorf("range %s contains the wrong refs", r)
+	}
+	if !(RefRange{From: b}).Contains(Ref{Fno: 999}) {
+		t.Errorf("a range with null To should be unbounded")
+	}
+
+	db := &DB{MaxFileLength: 0x1000}
+	if d := db.Distance(a, b); d != 0x100 {
+		t.Errorf("distance %s %s: %d", a, b, d)
+	}
+	if d := db.Distance(b, c); d != 0x1000-0x200+0x10 {
+		t.Errorf("distance %s %s: %d", b, c, d)
+	}
+	if d := db.Distance(c, a); d != -(0x1000 - 0x100 + 0x10) {
+		t.Errorf("distance %s %s: %d", c, a, d)
+	}
+}
+
+func Test_RefMap(t *testing.T) {
+	old := Ref{Fno: 1, Pos: 0x40, Store: 0x1f2e, Check: 5}
+	copied := Ref{Fno: 0, Pos: 0x10, Store: 0x0a0b, Check: 7}
+
+	var buf bytes.Buffer
+	w := NewRefMapWriter(&buf)
+	w.Add(old, copied)
+	w.Add(Ref{Fno: 1, Pos: 0x80}, Ref{Fno: 0, Pos: 0x30})
+	err := w.Flush()
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	m, err := ReadRefMap(&buf)
+	if err != nil {
+		t.Fatalf("read ref map: %v", err)
+	}
+	for _, ref := range []Ref{old, {Fno: old.Fno, Pos: old.Pos}} {
+		ref2, err := m.Apply(ref)
+		if err != nil || ref2 != copied {
+			t.Errorf("%s should map to %s, but: %s %v", ref, copied, ref2, err)
+		}
+	}
+
+	_, err = m.Apply(Ref{Fno: 1, Pos: 0x60})
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("unmapped ref should fail with ErrInvalidRef, but: %v", err)
+	}
+
+	_, err = ReadRefMap(strings.NewReader("00001:00000040 00000:00000010\n"))
+	if err == nil {
+		t.Errorf("ref map without tab should not parse")
+	}
+}
+
+func Test_WriteV2Refs(t *testing.T) {
+	db, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(db)
+	db.ExtendedRefs = true
+
+	// start in the last v1 file
+	db.writePos = Ref{Fno: maxV1Fno}
+	var refs []Ref
+	for i := 0; i < 10; i++ {
+		ref, err := db.Write([]byte(fmt.Sprintf("blob number %d", i)))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+	last := refs[len(refs)-1]
+	if last.Fno != maxV1Fno+1 || len(last.String()) != xwrefLength {
+		t.Fatalf("writes should continue in file %d with v2 refs, but: %s", maxV1Fno+1, last)
+	}
+
+	db.Close()
+	db, err := OpenRW(db.name)
+	if err != nil {
+		t.Fatalf("can not reopen db: %v", err)
+	}
+	defer db.Close()
+	db.MaxFileLength = 256
+	if db.writePos.Fno != maxV1Fno+1 {
+		t.Errorf("v2 write position should be read back, but: %s", db.writePos)
+	}
+
+	ro, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+	ro.ExtendedRefs = true
+
+	n := 0
+	for c := ro.Cursor(Ref{Fno: maxV1Fno}); c.Next() && n < len(refs); n++ {
+		b, err := ro.Read(c.Ref())
+		if err != nil || c.Ref() != refs[n] || string(b) != fmt.Sprintf("blob number %d", n) {
+			t.Errorf("cursor at %s should be blob number %d at %s: %q %v", c.Ref(), n, refs[n], b, err)
+		}
+	}
+	if n != len(refs) {
+		t.Errorf("cursor should visit %d blobs across the v1 limit, but: %d", len(refs), n)
+	}
+
+	// no panic when the limits are reached
+	db.writePos = Ref{Fno: MaxNumberFilesV2, Pos: 240}
+	_, err = db.Write([]byte("one too many"))
+	if errors.Cause(err) != ErrStoreFull {
+		t.Errorf("write beyond the last file should fail with ErrStoreFull, but: %v", err)
+	}
+	big := make([]byte, 512)
+	rand.Read(big)
+	_, err = db.Write(big)
+	if err == nil {
+		t.Errorf("write of a blob larger than a file should fail")
+	}
+}
@@ -0,0 +1,70 @@
+package bobstore
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RefMap maps the refs of blobs copied to another db to their refs in the copy.
+//
+// It is stored as text with a line "OLD\tNEW" per blob, see RefMapWriter.
+// Refs are looked up by position, the store of extended refs is not compared.
+type RefMap map[Ref]Ref
+
+// Apply gives the ref of the copy of the blob at ref
+func (m RefMap) Apply(ref Ref) (Ref, error) {
+	ref2, ok := m[Ref{Fno: ref.Fno, Pos: ref.Pos}]
+	if !ok {
+		return Ref{}, errors.Wrapf(ErrInvalidRef, "%s: not in ref map", ref)
+	}
+	return ref2, nil
+}
+
+// ReadRefMap reads a ref map written by a RefMapWriter
+func ReadRefMap(r io.Reader) (RefMap, error) {
+	m := make(RefMap)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, errors.Errorf("ref map line %d: expected OLD\\tNEW", n)
+		}
+		from, err := ParseRef(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "ref map line %d", n)
+		}
+		to, err := ParseRef(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "ref map line %d", n)
+		}
+		m[Ref{Fno: from.Fno, Pos: from.Pos}] = to
+	}
+
+	return m, errors.Wrap(scanner.Err(), "read ref map")
+}
+
+// RefMapWriter writes the ref map while copying,
+// so it does not have to be kept in memory
+type RefMapWriter struct {
+	w *bufio.Writer
+}
+
+// NewRefMapWriter writes the ref map to w
+func NewRefMapWriter(w io.Writer) *RefMapWriter {
+	return &RefMapWriter{w: bufio.NewWriter(w)}
+}
+
+// Add the mapping of ref from to ref to
+func (w *RefMapWriter) Add(from, to Ref) error {
+	_, err := w.w.WriteString(from.String() + "\t" + to.String() + "\n")
+	return err
+}
+
+// Flush writes the buffered mappings
+func (w *RefMapWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,333 @@
+package bobstore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// replicationLimit is the size in bytes up to which a replication chunk
+// is filled with records, a chunk has at least one record
+const replicationLimit = 4 * 1024 * 1024
+
+// replicationChunk gives the committed bytes of data file from.Fno starting
+// at from.Pos and the position after them, which is the start of the next data
+// file at the end of a completed one.  The chunk ends at a record boundary.
+//
+// committed is the position up to which all records are completely written.
+func replicationChunk(db *DB, from Ref, limit uint32) (b []byte, next, committed Ref, err error) {
+	if db.writer == nil {
+		return nil, Ref{}, Ref{}, errors.New("opened read-only")
+	}
+
+	from = Ref{Fno: from.Fno, Pos: from.Pos}
+	committed = committedPosition(db)
+	if committed.Less(from) {
+		return nil, Ref{}, Ref{}, errors.Errorf("%s is after the committed position %s", from, committed)
+	}
+
+	end := committed.Pos
+	if from.Fno < committed.Fno {
+		// deleted files are replicated as empty files
+		if !fileExists(db, from.Fno) {
+			return nil, Ref{Fno: from.Fno + 1}, committed, nil
+		}
+
+		var size int64
+		size, err = dataFileSize(db, from.Fno)
+		if err != nil {
+			return nil, Ref{}, Ref{}, err
+		}
+		end = uint32(size)
+		if from.Pos >= end {
+			return nil, Ref{Fno: from.Fno + 1}, committed, nil
+		}
+	}
+	if from.Pos >= end {
+		// caught up
+		return nil, from, committed, nil
+	}
+
+	dbf, err := getDataFile(db, from.Fno)
+	if err != nil {
+		return nil, Ref{}, Ref{}, err
+	}
+
+	if end-from.Pos > limit {
+		end = chunkEnd(dbf, from.Pos, end, limit)
+	}
+
+	b = make([]byte, end-from.Pos)
+	_, err = dbf.file.ReadAt(b, int64(from.Pos))
+	if err != nil {
+		return nil, Ref{}, Ref{}, errors.Wrapf(err, "read failed for %s", from)
+	}
+
+	return b, Ref{Fno: from.Fno, Pos: end}, committed, nil
+}
+
+// chunkEnd gives the end of the last record that fits into limit bytes after pos
+func chunkEnd(dbf *dbFile, pos, end, limit uint32) uint32 {
+	first := pos
+	if first < dbf.start {
+		first = dbf.start
+	}
+
+	cut := first
+	var hb [headerSize]byte
+	for cut < end {
+		_, err := dbf.file.ReadAt(hb[:], int64(cut))
+		if err != nil {
+			// the rest of the committed bytes, the follower reads them like the primary
+			return end
+		}
+		h := (*header)(unsafe.Pointer(&hb[0]))
+
+		if uint64(cut)+h.recordSize() > uint64(end) {
+			return end
+		}
+		next := cut + uint32(h.recordSize())
+		if next-pos > limit && cut > first {
+			break
+		}
+		cut = next
+	}
+
+	return cut
+}
+
+func dataFileSize(db *DB, fno uint32) (int64, error) {
+	f, err := getFile(db, fno)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "stat %05d", fno)
+	}
+	return fi.Size(), nil
+}
+
+// Follower replicates a primary served by NewHandler into a local db.
+//
+// The records are copied byte for byte, so they have the same refs as on
+// the primary.  The applied position is the write position of the local db,
+// so the follower continues where it stopped.  The local db has to be opened
+// read-write and must not be written to otherwise, its indexes are not maintained.
+type Follower struct {
+	// PollInterval is the wait in Run after the follower caught up
+	PollInterval time.Duration
+
+	db      *DB
+	primary *Client
+
+	lock sync.Mutex
+	// committed position of the primary at the last request
+	committed Ref
+}
+
+// NewFollower replicates the primary into db
+func NewFollower(db *DB, primary *Client) (*Follower, error) {
+	if db.writer == nil {
+		return nil, errors.New("follower db must be opened read-write")
+	}
+
+	return &Follower{PollInterval: time.Second, db: db, primary: primary}, nil
+}
+
+// Applied gives the position up to which the primary is replicated
+func (fl *Follower) Applied() Ref {
+	fl.db.lock.Lock()
+	defer fl.db.lock.Unlock()
+	return fl.db.writePos
+}
+
+// Lag gives the distance in bytes from the applied position to the
+// committed position of the primary at the last request, see DB.Distance
+func (fl *Follower) Lag() int64 {
+	fl.lock.Lock()
+	committed := fl.committed
+	fl.lock.Unlock()
+
+	return fl.db.Distance(fl.Applied(), committed)
+}
+
+// Sync applies the records committed on the primary until the follower caught up
+func (fl *Follower) Sync() error {
+	// the store id for extended refs and the pipelines
+	m, err := fl.primary.manifest()
+	if err != nil {
+		return err
+	}
+	err = applyManifest(fl.db, m)
+	if err != nil {
+		return err
+	}
+
+	for {
+		applied := fl.Applied()
+		b, next, committed, err := fl.primary.replicate(applied)
+		if err != nil {
+			return err
+		}
+
+		fl.lock.Lock()
+		fl.committed = committed
+		fl.lock.Unlock()
+
+		if next.Compare(applied) == 0 {
+			return nil
+		}
+
+		err = applyChunk(fl.db, applied, b, next)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Run syncs until the context is done or a sync fails
+func (fl *Follower) Run(ctx context.Context) error {
+	for {
+		err := fl.Sync()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(fl.PollInterval):
+		}
+	}
+}
+
+// applyManifest adopts the manifest of the primary
+func applyManifest(db *DB, m *manifest) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return xAdoptManifest(db, m)
+}
+
+// applyChunk writes the bytes of a replication chunk at the write position
+// and advances the write position to next
+func applyChunk(db *DB, at Ref, b []byte, next Ref) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.writePos != at {
+		return errors.Errorf("follower is at %s, not %s", db.writePos, at)
+	}
+
+	if len(b) > 0 {
+		dbf, err := xGetDataFile(db, at.Fno)
+		if err != nil {
+			return err
+		}
+
+		_, err = dbf.file.WriteAt(b, int64(at.Pos))
+		if err != nil {
+			return errors.Wrapf(err, "write failed for %s", at)
+		}
+
+		// the file header of the primary replaces ours
+		if at.Pos < fileHeaderSize {
+			err = readFileHeader(db, at.Fno, dbf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	db.writePos = next
+	return writeWriterRef(db)
+}
+
+// manifest gets the manifest of the primary
+func (cl *Client) manifest() (*manifest, error) {
+	resp, err := cl.get("/manifest", "manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp.Body)
+
+	m := &manifest{}
+	err = json.NewDecoder(resp.Body).Decode(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse manifest")
+	}
+	return m, nil
+}
+
+// replicate gets the replication chunk at from
+func (cl *Client) replicate(from Ref) (b []byte, next, committed Ref, err error) {
+	what := "replicate from " + from.String()
+	resp, err := cl.get("/replicate?from="+url.QueryEscape(from.String()), what)
+	if err != nil {
+		return nil, Ref{}, Ref{}, err
+	}
+	defer drain(resp.Body)
+
+	next, err = ParseRef(resp.Header.Get("X-Bobstore-Next"))
+	if err != nil {
+		return nil, Ref{}, Ref{}, errors.Wrap(err, what)
+	}
+	committed, err = ParseRef(resp.Header.Get("X-Bobstore-Committed"))
+	if err != nil {
+		return nil, Ref{}, Ref{}, errors.Wrap(err, what)
+	}
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Ref{}, Ref{}, errors.Wrap(err, what)
+	}
+	if next.Fno == from.Fno && int64(next.Pos)-int64(from.Pos) != int64(len(b)) {
+		return nil, Ref{}, Ref{}, errors.Errorf("%s: got %d bytes, expected up to %s", what, len(b), next)
+	}
+
+	return b, next, committed, nil
+}
+
+// replicate serves the replication chunk at from with the next and
+// committed positions in the X-Bobstore-Next and X-Bobstore-Committed headers
+func (s *handler) replicate(w http.ResponseWriter, r *http.Request) {
+	from, err := ParseRef(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, next, committed, err := replicationChunk(s.db, from, replicationLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("X-Bobstore-Next", next.String())
+	w.Header().Set("X-Bobstore-Committed", committed.String())
+	w.Write(b)
+}
+
+func (s *handler) manifest(w http.ResponseWriter) {
+	s.db.lock.Lock()
+	b, err := json.Marshal(s.db.manifest)
+	s.db.lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,123 @@
+package bobstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func Test_Follower(t *testing.T) {
+	primary, refs := openScanTestDB(t, 30)
+	defer closeScanTestDB(primary)
+
+	srv := httptest.NewServer(NewHandler(primary))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open follower db: %v", err)
+	}
+	fl, err := NewFollower(db, NewClient(srv.URL))
+	if err != nil {
+		t.Fatalf("new follower: %v", err)
+	}
+	err = fl.Sync()
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	db.Close()
+
+	// the follower continues from its applied position
+	for i := 30; i < 40; i++ {
+		ref, err := primary.Write([]byte(fmt.Sprintf("blob number %d", i)))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+
+	db, err = OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not reopen follower db: %v", err)
+	}
+	defer db.Close()
+	db.MaxFileLength = primary.MaxFileLength
+	fl, _ = NewFollower(db, NewClient(srv.URL))
+	err = fl.Sync()
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if fl.Applied() != committedPosition(primary) {
+		t.Errorf("follower should have applied up to %s, but: %s", committedPosition(primary), fl.Applied())
+	}
+	if fl.Lag() != 0 {
+		t.Errorf("follower should not lag after sync, but: %d", fl.Lag())
+	}
+
+	// same refs, same store
+	for i, ref := range refs {
+		b, err := db.Read(ref)
+		if err != nil {
+			t.Fatalf("follower read %s: %v", ref, err)
+		}
+		if string(b) != fmt.Sprintf("blob number %d", i) {
+			t.Errorf("follower %s should be blob number %d, but: %q", ref, i, b)
+		}
+	}
+
+	fnos, _ := dataFiles(primary)
+	for _, fno := range fnos {
+		pb, _ := ioutil.ReadFile(dataFileName(primary, fno))
+		fb, _ := ioutil.ReadFile(dataFileName(db, fno))
+		if !bytes.Equal(pb, fb) {
+			t.Errorf("data file %05d should be identical on the follower", fno)
+		}
+	}
+}
+
+func Test_ReplicationChunk(t *testing.T) {
+	db, refs := openScanTestDB(t, 5)
+	defer closeScanTestDB(db)
+	db.MaxFileLength = MaxFileLength
+
+	// records are never split
+	b, next, _, err := replicationChunk(db, refs[0], 1)
+	if err != nil {
+		t.Fatalf("replication chunk: %v", err)
+	}
+	if next.Compare(refs[1]) != 0 || uint32(len(b)) != refs[1].Pos-refs[0].Pos {
+		t.Errorf("chunk with limit 1 should be the record at %s, but up to %s: %d bytes", refs[0], next, len(b))
+	}
+
+	pending := Ref{Fno: db.writePos.Fno, Pos: db.writePos.Pos}
+	db.pending = append(db.pending, pending)
+	if committedPosition(db) != pending {
+		t.Errorf("committed position should be the pending write %s, but: %s", pending, committedPosition(db))
+	}
+	written(db, pending)
+
+	// a failed reservation is not pending
+	writer := db.writer
+	db.writer, _ = os.Open(writer.Name())
+	_, err = db.Write([]byte("not written"))
+	db.writer.Close()
+	db.writer = writer
+	if err == nil || len(db.pending) != 0 {
+		t.Errorf("failed write should leave no pending record, but: %v %v", db.pending, err)
+	}
+
+	_, _, _, err = replicationChunk(db, Ref{Fno: 99}, replicationLimit)
+	if err == nil {
+		t.Errorf("replication after the committed position should fail")
+	}
+}
@@ -0,0 +1,222 @@
+package bobstore
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// scanReadAhead is the read-ahead buffer size of the cursors used for scanning
+const scanReadAhead = 1024 * 1024
+
+// ScanFunc is called by Scan and ScanOrdered for every blob.
+// Returning an error stops the scan.
+type ScanFunc func(ref Ref, blob []byte) error
+
+// Scan calls fn for every blob in the db.
+//
+// The data files are partitioned between workers which read and decode
+// them in parallel, so fn is called concurrently and in no particular order.
+// workers <= 0 means one worker per CPU.
+//
+// Scan stops on the first error returned by fn or when ctx is done
+// and returns that error.
+func (db *DB) Scan(ctx context.Context, workers int, fn ScanFunc) error {
+	fnos, err := dataFiles(db)
+	if err != nil {
+		return err
+	}
+
+	parts := make([]scanPart, len(fnos))
+	for i, fno := range fnos {
+		parts[i] = scanPart{db: db, fno: fno}
+	}
+	return scanParts(ctx, workers, parts, fn)
+}
+
+// scanPart is a data file scanned by a Scan worker
+type scanPart struct {
+	db  *DB
+	fno uint32
+}
+
+// scanParts partitions the data files between the workers
+func scanParts(ctx context.Context, workers int, parts []scanPart, fn ScanFunc) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	files := make(chan scanPart)
+	var wg sync.WaitGroup
+	for i := 0; i < scanWorkers(workers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range files {
+				err := scanFile(ctx, part.db, part.fno, fn)
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, part := range parts {
+		select {
+		case files <- part:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(files)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = parent.Err()
+	}
+
+	return firstErr
+}
+
+// scanFile calls fn for every blob in a single data file
+func scanFile(ctx context.Context, db *DB, fno uint32, fn ScanFunc) error {
+	to := Ref{Fno: fno + 1}
+	if fno == MaxNumberFilesV2 {
+		// the last file, there is no next one
+		to = Ref{Fno: fno, Pos: ^uint32(0)}
+	}
+	c := db.CursorRange(Ref{Fno: fno}, to)
+	c.SetReadAhead(scanReadAhead)
+	for c.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		blob, err := c.Blob()
+		if err != nil {
+			return err
+		}
+
+		err = fn(c.Ref(), blob)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Error()
+}
+
+// scanResult is a decoded blob for the ordered scan
+type scanResult struct {
+	ref  Ref
+	blob []byte
+	err  error
+}
+
+// scanJob is a blob read by the ordered scan, waiting to be decoded
+type scanJob struct {
+	ref        Ref
+	h          header
+	compressed []byte
+	done       chan scanResult
+}
+
+// ScanOrdered is like Scan, but fn is called sequentially in ref order.
+//
+// The blobs are read sequentially and decoded by workers in parallel.
+func (db *DB) ScanOrdered(ctx context.Context, workers int, fn ScanFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := scanWorkers(workers)
+	jobs := make(chan scanJob, n)
+	// bounds the number of blobs in flight
+	order := make(chan chan scanResult, 2*n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				blob, err := decode(db, &job.h, job.ref, job.compressed)
+				job.done <- scanResult{ref: job.ref, blob: blob, err: err}
+			}
+		}()
+	}
+
+	// read sequentially, errors are passed in order
+	go func() {
+		defer close(order)
+		defer close(jobs)
+
+		c := db.Cursor(Ref{})
+		c.SetReadAhead(scanReadAhead)
+		for c.Next() {
+			done := make(chan scanResult, 1)
+			compressed, err := c.Raw()
+			if err != nil {
+				done <- scanResult{ref: c.Ref(), err: err}
+			}
+
+			select {
+			case order <- done:
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+			jobs <- scanJob{ref: c.Ref(), h: c.h, compressed: compressed, done: done}
+		}
+		if c.Error() != nil {
+			done := make(chan scanResult, 1)
+			done <- scanResult{err: c.Error()}
+			select {
+			case order <- done:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	var err error
+	for done := range order {
+		select {
+		case r := <-done:
+			err = r.err
+			if err == nil {
+				err = fn(r.ref, r.blob)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	cancel()
+	// drain so the reader can finish
+	for range order {
+	}
+	wg.Wait()
+
+	return err
+}
+
+func scanWorkers(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
@@ -0,0 +1,143 @@
+package bobstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func openScanTestDB(t *testing.T, n int) (*DB, []Ref) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+
+	db, err := OpenRW(dir)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	// small files so the scan gets several data files
+	db.MaxFileLength = 256
+
+	refs := make([]Ref, n)
+	for i := range refs {
+		refs[i], err = db.Write([]byte(fmt.Sprintf("blob number %d", i)))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	return db, refs
+}
+
+func closeScanTestDB(db *DB) {
+	db.Close()
+	os.RemoveAll(db.name)
+}
+
+func Test_Scan(t *testing.T) {
+	db, refs := openScanTestDB(t, 50)
+	defer closeScanTestDB(db)
+
+	var lock sync.Mutex
+	seen := make(map[Ref]string)
+	err := db.Scan(context.Background(), 4, func(ref Ref, blob []byte) error {
+		lock.Lock()
+		seen[ref] = string(blob)
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Errorf("scan: %v", err)
+	}
+	if len(seen) != len(refs) {
+		t.Errorf("scan should have seen %d blobs, but: %d", len(refs), len(seen))
+	}
+	for i, ref := range refs {
+		if seen[ref] != fmt.Sprintf("blob number %d", i) {
+			t.Errorf("blob %s: %q", ref, seen[ref])
+		}
+	}
+
+	stop := errors.New("stop")
+	err = db.Scan(context.Background(), 4, func(ref Ref, blob []byte) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("scan should have returned the error of fn, but: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.Scan(ctx, 4, func(ref Ref, blob []byte) error {
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("scan should have been canceled, but: %v", err)
+	}
+}
+
+func Test_ScanOrdered(t *testing.T) {
+	db, refs := openScanTestDB(t, 50)
+	defer closeScanTestDB(db)
+
+	i := 0
+	err := db.ScanOrdered(context.Background(), 4, func(ref Ref, blob []byte) error {
+		if i >= len(refs) || ref != refs[i] || string(blob) != fmt.Sprintf("blob number %d", i) {
+			return fmt.Errorf("unexpected blob %d: %s %q", i, ref, blob)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("scan ordered: %v", err)
+	}
+	if i != len(refs) {
+		t.Errorf("scan ordered should have seen %d blobs, but: %d", len(refs), i)
+	}
+
+	stop := errors.New("stop")
+	i = 0
+	err = db.ScanOrdered(context.Background(), 4, func(ref Ref, blob []byte) error {
+		i++
+		if i == 10 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || i != 10 {
+		t.Errorf("scan ordered should have stopped at 10: %d %v", i, err)
+	}
+}
+
+func Test_ScanLastFile(t *testing.T) {
+	db, _ := openScanTestDB(t, 3)
+	defer closeScanTestDB(db)
+
+	db.writePos = Ref{Fno: MaxNumberFilesV2}
+	ref, err := db.Write([]byte("in the last file"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var refs []Ref
+	err = scanFile(context.Background(), db, MaxNumberFilesV2, func(ref Ref, blob []byte) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	if err != nil || len(refs) != 1 || refs[0] != ref {
+		t.Errorf("scan of the last file should only give %s, but: %v %v", ref, refs, err)
+	}
+
+	n := 0
+	for c := db.Cursor(ref); c.Next() && n < 10; n++ {
+	}
+	if n != 1 {
+		t.Errorf("cursor should end with the last file, but visited %d blobs", n)
+	}
+}
@@ -0,0 +1,330 @@
+package bobstore
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// handler serves a db over http, see NewHandler
+type handler struct {
+	db *DB
+}
+
+// cursorLine is a blob in the NDJSON stream of GET /cursor
+type cursorLine struct {
+	Ref        Ref    `json:"ref"`
+	Typ        string `json:"typ"`
+	Length     uint32 `json:"length"`
+	Compressed uint32 `json:"compressed"`
+	JSON       bool   `json:"json,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	Meta       Meta   `json:"meta,omitempty"`
+	Blob       []byte `json:"blob,omitempty"`
+
+	// Next ends a stream cut short by limit, it is the from of the next request
+	Next *Ref `json:"next,omitempty"`
+	// Error ends the stream
+	Error string `json:"error,omitempty"`
+}
+
+// NewHandler returns a http.Handler serving the db:
+//
+//	GET /blobs/REF          the blob, gzip-stored blobs are passed through
+//	                        with Content-Encoding: gzip if the client accepts it
+//	HEAD /blobs/REF         the length of the blob in Content-Length
+//	POST /blobs[?codec=TYP] writes the request body, responds with the new ref
+//	GET /cursor?from=REF    all blobs from REF (to=REF is optional) as NDJSON,
+//	                        up to the committed position without to,
+//	                        with limit=N only the first N blobs followed by {"next":REF}
+//	GET /position           the write position
+//	GET /replicate?from=REF the committed bytes of a data file from REF, see Follower
+//	GET /manifest           the manifest of the db
+//
+// Writes need a db opened read-write, POST responds with 403 otherwise.
+// Bodies larger than MaxFileLength are rejected with 413.
+func NewHandler(db *DB) http.Handler {
+	return &handler{db: db}
+}
+
+func (s *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/blobs" || r.URL.Path == "/blobs/":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		s.post(w, r)
+	case strings.HasPrefix(r.URL.Path, "/blobs/"):
+		ref, err := ParseRef(strings.TrimPrefix(r.URL.Path, "/blobs/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.get(w, r, ref)
+		case http.MethodHead:
+			s.head(w, ref)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		}
+	case r.URL.Path == "/position":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.position(w)
+	case r.URL.Path == "/replicate" || r.URL.Path == "/manifest":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		if r.URL.Path == "/replicate" {
+			s.replicate(w, r)
+		} else {
+			s.manifest(w)
+		}
+	case r.URL.Path == "/cursor":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.cursor(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// readError responds with 404 for refs that do not point to a blob
+func readError(w http.ResponseWriter, err error) {
+	switch cause := errors.Cause(err); {
+	case cause == ErrInvalidRef, cause == io.EOF, cause == io.ErrUnexpectedEOF, os.IsNotExist(cause):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func contentType(h *header) string {
+	if h.Flags&flagJSON != 0 {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+func (s *handler) get(w http.ResponseWriter, r *http.Request, ref Ref) {
+	h, compressed, err := readRaw(s.db, ref)
+	if err != nil {
+		readError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType(&h))
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// the stored bytes are a gzip stream
+	if string(h.Typ[:]) == "GZIP" && h.Flags&flagEncrypted == 0 && acceptsGZIP(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		w.Write(compressed)
+		return
+	}
+
+	b, err := decode(s.db, &h, ref, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+func acceptsGZIP(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.SplitN(enc, ";", 2)
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		if len(parts) == 1 {
+			return true
+		}
+		// gzip;q=0 means not acceptable
+		q := strings.TrimPrefix(strings.TrimSpace(parts[1]), "q=")
+		f, err := strconv.ParseFloat(q, 64)
+		return err != nil || f > 0
+	}
+	return false
+}
+
+// head only reads the header, the length is recorded there
+func (s *handler) head(w http.ResponseWriter, ref Ref) {
+	_, h, err := readHeader(s.db, ref)
+	if err != nil {
+		readError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType(&h))
+	w.Header().Set("Content-Length", strconv.FormatUint(uint64(h.Length), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *handler) post(w http.ResponseWriter, r *http.Request) {
+	if s.db.writer == nil {
+		http.Error(w, "opened read-only", http.StatusForbidden)
+		return
+	}
+
+	// no blob is larger than a data file
+	limit := int64(s.db.MaxFileLength)
+	if r.ContentLength > limit {
+		http.Error(w, "blob larger than a data file", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	codec := snappyCodec
+	if typ := r.URL.Query().Get("codec"); typ != "" {
+		codec = s.db.codecFor(typ)
+		if codec == nil {
+			http.Error(w, "unknown codec "+typ, http.StatusBadRequest)
+			return
+		}
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil && int64(len(b)) >= limit {
+		http.Error(w, "blob larger than a data file", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ref, err := s.db.WriteWithCodec(b, codec)
+	if errors.Cause(err) == ErrStoreFull {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", "/blobs/"+ref.String())
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, ref.String()+"\n")
+}
+
+func (s *handler) position(w http.ResponseWriter) {
+	ref, err := s.db.WritePosition()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, ref.String()+"\n")
+}
+
+// cursor streams the blobs as NDJSON.  Errors after the first line
+// can not change the status any more, they end the stream with an error line.
+func (s *handler) cursor(w http.ResponseWriter, r *http.Request) {
+	var rng RefRange
+	for name, ref := range map[string]*Ref{"from": &rng.From, "to": &rng.To} {
+		if v := r.URL.Query().Get(name); v != "" {
+			var err error
+			*ref, err = ParseRef(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	limit := -1
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// records after the committed position may not be written yet
+	if rng.To.IsZero() {
+		committed, err := committedWatermark(s.db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rng.To = snapshotWatermark(committed)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	c := s.db.CursorRange(rng.From, rng.To)
+	c.SetReadAhead(scanReadAhead)
+	for c.Next() {
+		if limit == 0 {
+			// c.ref is the first blob not sent
+			next := c.ref
+			enc.Encode(&cursorLine{Next: &next})
+			return
+		}
+		limit--
+
+		line := cursorLine{
+			Ref:        c.Ref(),
+			Typ:        c.Typ(),
+			Length:     c.Length(),
+			Compressed: c.Compressed(),
+			JSON:       c.JSON(),
+			Encrypted:  c.Encrypted(),
+		}
+		var err error
+		line.Meta, err = c.Meta()
+		if err == nil {
+			line.Blob, err = c.Blob()
+		}
+		if err != nil {
+			enc.Encode(&cursorLine{Error: err.Error()})
+			return
+		}
+
+		err = enc.Encode(&line)
+		if err != nil {
+			// client went away
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+	}
+	if c.Error() != nil {
+		enc.Encode(&cursorLine{Error: c.Error().Error()})
+	}
+}
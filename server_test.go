@@ -0,0 +1,154 @@
+package bobstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Server(t *testing.T) {
+	db, refs := openScanTestDB(t, 10)
+	defer closeScanTestDB(db)
+
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/blobs/" + refs[3].String())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "blob number 3" {
+		t.Errorf("get %s should give blob number 3, but: %d %q", refs[3], resp.StatusCode, b)
+	}
+
+	resp, err = http.Head(srv.URL + "/blobs/" + refs[3].String())
+	if err != nil {
+		t.Fatalf("head: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != int64(len("blob number 3")) {
+		t.Errorf("head should give the length in Content-Length, but: %d", resp.ContentLength)
+	}
+
+	resp, err = http.Get(srv.URL + "/blobs/" + Ref{Fno: 99, Pos: 16}.String())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get of a missing blob should give 404, but: %d", resp.StatusCode)
+	}
+
+	// posted gzip blobs are served as they are stored
+	content := strings.Repeat("gzip me ", 20)
+	resp, err = http.Post(srv.URL+"/blobs?codec=GZIP", "application/octet-stream", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("post should give 201, but: %d %s", resp.StatusCode, b)
+	}
+	ref, err := ParseRef(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatalf("post should respond with the ref: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/blobs/"+ref.String(), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("gzip blob should be passed through, but Content-Encoding: %q", resp.Header.Get("Content-Encoding"))
+	}
+	unzipped, err := decodeGZIP(b)
+	if err != nil || string(unzipped) != content {
+		t.Errorf("passed through gzip blob should decode to the content, but: %q %v", unzipped, err)
+	}
+
+	// bodies larger than a data file, with and without Content-Length
+	big := strings.Repeat("x", int(db.MaxFileLength)+1)
+	for _, body := range []io.Reader{strings.NewReader(big), ioutil.NopCloser(strings.NewReader(big))} {
+		resp, err = http.Post(srv.URL+"/blobs", "application/octet-stream", body)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("post of %d bytes should give 413, but: %d", len(big), resp.StatusCode)
+		}
+	}
+
+	ro, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+	rosrv := httptest.NewServer(NewHandler(ro))
+	defer rosrv.Close()
+	resp, err = http.Post(rosrv.URL+"/blobs", "application/octet-stream", strings.NewReader("no"))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("post to a read-only db should give 403, but: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/cursor?from=" + refs[8].String())
+	if err != nil {
+		t.Fatalf("cursor: %v", err)
+	}
+	defer resp.Body.Close()
+	var lines []cursorLine
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line cursorLine
+		err = json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatalf("cursor line %q: %v", scanner.Bytes(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("cursor from %s should give 3 blobs, but: %d", refs[8], len(lines))
+	}
+	if lines[0].Ref != refs[8] || string(lines[0].Blob) != "blob number 8" {
+		t.Errorf("first cursor line should be %s, but: %+v", refs[8], lines[0])
+	}
+	if lines[2].Ref != ref || !bytes.Equal(lines[2].Blob, []byte(content)) || lines[2].Typ != "GZIP" {
+		t.Errorf("last cursor line should be the posted blob, but: %+v", lines[2])
+	}
+
+	// a reservation whose record is not written yet
+	h := header{Compressed: 32}
+	f, pending, err := reserve(db, &h)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	f.WriteAt(make([]byte, h.recordSize()), int64(pending.Pos))
+	defer written(db, pending)
+
+	resp, err = http.Get(srv.URL + "/cursor?from=" + ref.String())
+	if err != nil {
+		t.Fatalf("cursor: %v", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Count(b, []byte("\n")) != 1 || bytes.Contains(b, []byte(`"error"`)) {
+		t.Errorf("cursor should stop at the committed position before %s, but: %s", pending, b)
+	}
+}
@@ -0,0 +1,247 @@
+package bobstore
+
+import (
+	"context"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var _ Store = (*ShardedDB)(nil)
+
+// ShardedDB spreads the blobs over several dbs, the shards,
+// e.g. on different disks.
+//
+// The shard of a blob is identified by the store id in its extended ref,
+// so the store ids of the shards have to be distinct.  The shards give
+// out extended refs, plain refs can not be read from a ShardedDB.
+//
+// The store ids are assigned when the set is created: the shard at
+// position i in names gets id i+1, or the next one not taken by another
+// shard.  Shards that already hold blobs keep their id.  Shards of older
+// dbs without id that are opened read-only get their id the same way, but
+// only in memory, so their refs depend on the order of names.
+//
+// Writes go to the shards round-robin, WriteWithKey chooses the
+// shard by the hash of a key.  Cursors visit the shards one after the other.
+type ShardedDB struct {
+	shards  []*DB
+	byStore map[uint16]*DB
+	next    uint32
+}
+
+// OpenSharded opens the shards for reading
+func OpenSharded(names ...string) (*ShardedDB, error) {
+	return openSharded(Open, names)
+}
+
+// OpenShardedRW opens the shards for RW access
+func OpenShardedRW(names ...string) (*ShardedDB, error) {
+	return openSharded(OpenRW, names)
+}
+
+func openSharded(open func(string) (*DB, error), names []string) (*ShardedDB, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no shards")
+	}
+
+	s := &ShardedDB{byStore: make(map[uint16]*DB)}
+	// OpenRW gives shards without id a random one, they get the
+	// id of their position like on a read-only open instead
+	positional := make(map[*DB]bool)
+	for _, name := range names {
+		m, err := readManifestFile(name)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "shard %s", name)
+		}
+
+		db, err := open(name)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "shard %s", name)
+		}
+		s.shards = append(s.shards, db)
+		db.ExtendedRefs = true
+		positional[db] = m.StoreID == 0 || needsShardID(db)
+	}
+
+	// the ids the shards keep first, the new ones must not collide with them
+	for _, db := range s.shards {
+		if positional[db] {
+			continue
+		}
+		if other := s.byStore[db.storeID]; other != nil {
+			s.Close()
+			return nil, errors.Errorf("shards %s and %s have the same store id %04x", other.name, db.name, db.storeID)
+		}
+		s.byStore[db.storeID] = db
+	}
+	for i, db := range s.shards {
+		if !positional[db] {
+			continue
+		}
+		id := uint16(i + 1)
+		for s.byStore[id] != nil {
+			id++
+		}
+		err := assignStoreID(db, id)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "shard %s", db.name)
+		}
+		s.byStore[id] = db
+	}
+
+	return s, nil
+}
+
+// needsShardID is true if the shard gets its store id from its position:
+// it has none or holds no blobs yet
+func needsShardID(db *DB) bool {
+	if db.storeID == 0 {
+		return true
+	}
+	if db.writer == nil {
+		return false
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.writePos.IsZero() && len(db.pending) == 0
+}
+
+// Close all shards
+func (s *ShardedDB) Close() (xerr error) {
+	for _, db := range s.shards {
+		err := db.Close()
+		if err != nil {
+			xerr = err
+		}
+	}
+	return
+}
+
+// Shards gives the dbs of the shards in the order they were opened
+func (s *ShardedDB) Shards() []*DB {
+	return append([]*DB(nil), s.shards...)
+}
+
+// shard gives the shard of the ref
+func (s *ShardedDB) shard(ref Ref) (*DB, error) {
+	db := s.byStore[ref.Store]
+	if db == nil {
+		return nil, errors.Wrapf(ErrInvalidRef, "%s: no shard with store id %04x", ref, ref.Store)
+	}
+	return db, nil
+}
+
+// Read the blob at ref from its shard
+func (s *ShardedDB) Read(ref Ref) ([]byte, error) {
+	db, err := s.shard(ref)
+	if err != nil {
+		return nil, err
+	}
+	return db.Read(ref)
+}
+
+// nextShard gives the shard for the next round-robin write
+func (s *ShardedDB) nextShard() *DB {
+	n := atomic.AddUint32(&s.next, 1) - 1
+	return s.shards[n%uint32(len(s.shards))]
+}
+
+// keyShard gives the shard for the key
+func (s *ShardedDB) keyShard(key []byte) *DB {
+	h := fnv.New32a()
+	h.Write(key)
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Write to the next shard round-robin.  Will use the default SnappyCodec()
+func (s *ShardedDB) Write(b []byte) (Ref, error) {
+	return s.nextShard().Write(b)
+}
+
+// WriteWithCodec - write the blob to the next shard with explicit codec.
+func (s *ShardedDB) WriteWithCodec(b []byte, codec *Codec) (Ref, error) {
+	return s.nextShard().WriteWithCodec(b, codec)
+}
+
+// WriteWithMeta - write the blob to the next shard with explicit codec and metadata.
+func (s *ShardedDB) WriteWithMeta(b []byte, codec *Codec, meta Meta) (Ref, error) {
+	return s.nextShard().WriteWithMeta(b, codec, meta)
+}
+
+// WriteWithKey writes the blob to the shard chosen by the hash of key,
+// so blobs with the same key end up in the same shard.
+func (s *ShardedDB) WriteWithKey(key, b []byte, codec *Codec, meta Meta) (Ref, error) {
+	return s.keyShard(key).WriteWithMeta(b, codec, meta)
+}
+
+// WritePosition gives the write position of the whole set in cursor order,
+// which is the write position of the last shard: a cursor from it sees no
+// blobs written so far.  Writes go to all shards, see WritePositions for
+// the positions to follow them.
+func (s *ShardedDB) WritePosition() (Ref, error) {
+	db := s.shards[len(s.shards)-1]
+
+	// there is no blob yet to check against, but the store routes cursors
+	ref, err := db.WritePosition()
+	ref.Store = db.storeID
+	return ref, err
+}
+
+// WritePositions gives the write positions of all shards in the order they were opened
+func (s *ShardedDB) WritePositions() ([]Ref, error) {
+	refs := make([]Ref, len(s.shards))
+	for i, db := range s.shards {
+		ref, err := db.WritePosition()
+		if err != nil {
+			return nil, err
+		}
+		ref.Store = db.storeID
+		refs[i] = ref
+	}
+	return refs, nil
+}
+
+// Cursor iterates over the shards one after the other.
+// next is the initial ref, null value means beginning of the first shard.
+// Otherwise the cursor starts at next in its shard and continues with the
+// shards opened after it.
+func (s *ShardedDB) Cursor(next Ref) *Cursor {
+	chain := make([]*Cursor, 0, len(s.shards))
+	found := next == Ref{}
+	for _, db := range s.shards {
+		switch {
+		case found:
+			chain = append(chain, db.Cursor(Ref{}))
+		case db.storeID == next.Store:
+			chain = append(chain, db.Cursor(next))
+			found = true
+		}
+	}
+	if !found {
+		return &Cursor{chain: chain, err: errors.Wrapf(ErrInvalidRef, "%s: no shard with store id %04x", next, next.Store)}
+	}
+
+	return &Cursor{chain: chain}
+}
+
+// Scan calls fn for every blob in all shards, see DB.Scan.
+// The data files of all shards are partitioned between the workers.
+func (s *ShardedDB) Scan(ctx context.Context, workers int, fn ScanFunc) error {
+	var parts []scanPart
+	for _, db := range s.shards {
+		fnos, err := dataFiles(db)
+		if err != nil {
+			return err
+		}
+		for _, fno := range fnos {
+			parts = append(parts, scanPart{db: db, fno: fno})
+		}
+	}
+	return scanParts(ctx, workers, parts, fn)
+}
@@ -0,0 +1,177 @@
+package bobstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_ShardedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bobs")
+	if err != nil {
+		t.Fatalf("can not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+	s, err := OpenShardedRW(names...)
+	if err != nil {
+		t.Fatalf("can not open sharded db: %v", err)
+	}
+
+	for i, db := range s.Shards() {
+		if db.storeID != uint16(i+1) {
+			t.Errorf("shard %d of a new set should have store id %d, but: %04x", i, i+1, db.storeID)
+		}
+	}
+
+	refs := make(map[Ref]string)
+	perShard := make(map[uint16]int)
+	for i := 0; i < 30; i++ {
+		blob := fmt.Sprintf("sharded blob %d", i)
+		ref, err := s.Write([]byte(blob))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs[ref] = blob
+		perShard[ref.Store]++
+	}
+	for store, n := range perShard {
+		if n != 10 {
+			t.Errorf("round-robin should write 10 blobs to every shard, but %04x got %d", store, n)
+		}
+	}
+
+	r1, _ := s.WriteWithKey([]byte("customer 42"), []byte("keyed 1"), SnappyCodec(), nil)
+	r2, _ := s.WriteWithKey([]byte("customer 42"), []byte("keyed 2"), SnappyCodec(), nil)
+	if r1.Store != r2.Store {
+		t.Errorf("blobs with the same key should be in the same shard: %s %s", r1, r2)
+	}
+	refs[r1], refs[r2] = "keyed 1", "keyed 2"
+
+	for ref, blob := range refs {
+		b, err := s.Read(ref)
+		if err != nil || string(b) != blob {
+			t.Errorf("read %s should give %q, but: %q %v", ref, blob, b, err)
+		}
+	}
+	_, err = s.Read(Ref{Fno: 0, Pos: fileHeaderSize})
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("plain refs should fail with ErrInvalidRef, but: %v", err)
+	}
+
+	n := 0
+	c := s.Cursor(Ref{})
+	for c.Next() {
+		b, err := c.Blob()
+		if err != nil || string(b) != refs[c.Ref()] {
+			t.Errorf("cursor at %s should give %q, but: %q %v", c.Ref(), refs[c.Ref()], b, err)
+		}
+		n++
+	}
+	if c.Error() != nil || n != len(refs) {
+		t.Errorf("cursor should visit all %d blobs, but: %d %v", len(refs), n, c.Error())
+	}
+
+	// starting in the last shard
+	last := s.Shards()[2]
+	first := last.Cursor(Ref{})
+	first.Next()
+	n = 0
+	for c = s.Cursor(first.Ref()); c.Next(); n++ {
+		if c.Ref().Store != last.storeID {
+			t.Errorf("cursor from the last shard should stay there, but: %s", c.Ref())
+		}
+	}
+	if n == 0 {
+		t.Errorf("cursor from %s should visit the blobs of the last shard", first.Ref())
+	}
+
+	var lock sync.Mutex
+	scanned := 0
+	err = s.Scan(context.Background(), 2, func(ref Ref, blob []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		scanned++
+		if refs[ref] != string(blob) {
+			return fmt.Errorf("scan %s: %q", ref, blob)
+		}
+		return nil
+	})
+	if err != nil || scanned != len(refs) {
+		t.Errorf("scan should visit all %d blobs, but: %d %v", len(refs), scanned, err)
+	}
+
+	wpos, err := s.WritePosition()
+	if err != nil || wpos.Store != last.storeID || s.Cursor(wpos).Next() {
+		t.Errorf("write position %s should be the end of the last shard: %v", wpos, err)
+	}
+	positions, err := s.WritePositions()
+	if err != nil || len(positions) != 3 {
+		t.Fatalf("write positions: %v %v", positions, err)
+	}
+	for i, pos := range positions {
+		if pos.Store != uint16(i+1) || pos.IsZero() {
+			t.Errorf("write position of shard %d: %s", i, pos)
+		}
+	}
+
+	s.Close()
+
+	// shards with blobs keep their ids in any order
+	s, err = OpenShardedRW(names[2], names[0], names[1])
+	if err != nil {
+		t.Fatalf("can not open sharded db: %v", err)
+	}
+	for ref, blob := range refs {
+		b, err := s.Read(ref)
+		if err != nil || string(b) != blob {
+			t.Errorf("read %s after reopening should give %q, but: %q %v", ref, blob, b, err)
+		}
+	}
+	s.Close()
+
+	// a shard of an older db without store id
+	legacy := filepath.Join(dir, "legacy")
+	db, err := OpenRW(legacy)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	db.Write([]byte("legacy blob"))
+	db.Close()
+	os.Remove(filepath.Join(legacy, manifestFile))
+	s, err = OpenSharded(legacy, names[0])
+	if err != nil {
+		t.Fatalf("shard without store id should open read-only: %v", err)
+	}
+	c = s.Cursor(Ref{})
+	if !c.Next() || c.Ref().Store != 2 {
+		t.Errorf("shard without store id should get the first free id 2, but: %s", c.Ref())
+	}
+	legacyRef := c.Ref()
+	s.Close()
+
+	// read-write and later read-only opens keep the id
+	for _, open := range []func(...string) (*ShardedDB, error){OpenShardedRW, OpenSharded} {
+		s, err = open(legacy, names[0])
+		if err != nil {
+			t.Fatalf("can not open sharded db: %v", err)
+		}
+		b, err := s.Read(legacyRef)
+		if err != nil || string(b) != "legacy blob" {
+			t.Errorf("read %s: %q %v", legacyRef, b, err)
+		}
+		s.Close()
+	}
+
+	_, err = OpenSharded(names[0], names[0])
+	if err == nil {
+		t.Errorf("shards with the same store id should not open")
+	}
+}
@@ -0,0 +1,77 @@
+package bobstore
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Snapshot is a read-only view of the db pinned at a watermark:
+// only the blobs before the watermark are visible.
+//
+// The watermark can be stored, see SnapshotAt, so a later process
+// sees exactly the same blobs.
+type Snapshot struct {
+	db        *DB
+	watermark Ref
+}
+
+// Snapshot pins a view at the position up to which all records are
+// completely written.  Writes in progress and later writes are not visible.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	committed, err := committedWatermark(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{db: db, watermark: snapshotWatermark(committed)}, nil
+}
+
+// SnapshotAt pins a view at the watermark of an earlier snapshot
+func (db *DB) SnapshotAt(watermark Ref) (*Snapshot, error) {
+	committed, err := committedWatermark(db)
+	if err != nil {
+		return nil, err
+	}
+
+	watermark = snapshotWatermark(watermark)
+	if snapshotWatermark(committed).Less(watermark) {
+		return nil, errors.Errorf("watermark %s is after the end of the db %s", watermark, committed)
+	}
+	return &Snapshot{db: db, watermark: watermark}, nil
+}
+
+// snapshotWatermark gives the plain ref of the watermark.  For an empty db
+// it is not null, as a null To means the end of the db for cursors:
+// the first record of a new db is after the file header.
+func snapshotWatermark(watermark Ref) Ref {
+	if watermark.IsZero() {
+		return Ref{Pos: fileHeaderSize}
+	}
+	return Ref{Fno: watermark.Fno, Pos: watermark.Pos}
+}
+
+// Watermark gives the position the snapshot is pinned at
+func (s *Snapshot) Watermark() Ref {
+	return s.watermark
+}
+
+// Read the blob at ref, refs after the watermark are invalid
+func (s *Snapshot) Read(ref Ref) ([]byte, error) {
+	if !ref.Less(s.watermark) {
+		return nil, errors.Wrapf(ErrInvalidRef, "%s: after the snapshot at %s", ref, s.watermark)
+	}
+	return s.db.Read(ref)
+}
+
+// Cursor iterates over the snapshot.
+// next is the initial ref, null value means beginning of DB.
+func (s *Snapshot) Cursor(next Ref) *Cursor {
+	return s.db.CursorRange(next, s.watermark)
+}
+
+// CursorRange iterates over the blobs of the snapshot in [from, to),
+// a null to means the watermark
+func (s *Snapshot) CursorRange(from, to Ref) *Cursor {
+	if to.IsZero() || s.watermark.Less(to) {
+		to = s.watermark
+	}
+	return s.db.CursorRange(from, to)
+}
@@ -0,0 +1,65 @@
+package bobstore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Snapshot(t *testing.T) {
+	db, refs := openScanTestDB(t, 20)
+	defer closeScanTestDB(db)
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	wm, _ := json.Marshal(snap.Watermark())
+
+	later, err := db.Write([]byte("after the snapshot"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	_, err = snap.Read(later)
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("read after the watermark should fail with ErrInvalidRef, but: %v", err)
+	}
+	_, err = snap.Read(refs[19])
+	if err != nil {
+		t.Errorf("read before the watermark: %v", err)
+	}
+
+	// a later process reproduces the snapshot from the watermark
+	var watermark Ref
+	json.Unmarshal(wm, &watermark)
+	snap2, err := db.SnapshotAt(watermark)
+	if err != nil {
+		t.Fatalf("snapshot at %s: %v", watermark, err)
+	}
+	for _, s := range []*Snapshot{snap, snap2} {
+		n := 0
+		c := s.Cursor(Ref{})
+		for c.Next() {
+			n++
+		}
+		if c.Error() != nil || n != len(refs) {
+			t.Errorf("snapshot cursor should see %d blobs, but: %d %v", len(refs), n, c.Error())
+		}
+	}
+
+	_, err = db.SnapshotAt(Ref{Fno: 999})
+	if err == nil {
+		t.Errorf("snapshot after the end of the db should fail")
+	}
+
+	// empty db
+	empty, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(empty)
+	snap, _ = empty.Snapshot()
+	empty.Write([]byte("after the snapshot"))
+	if c := snap.Cursor(Ref{}); c.Next() {
+		t.Errorf("snapshot of an empty db should be empty, but: %s", c.Ref())
+	}
+}
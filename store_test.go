@@ -0,0 +1,127 @@
+package bobstore
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// testStore is the conformance test for Store implementations,
+// s must be an empty read-write store.
+func testStore(t *testing.T, s Store) {
+	pos, err := s.WritePosition()
+	if err != nil {
+		t.Fatalf("write position: %v", err)
+	}
+
+	var refs []Ref
+	for i := 0; i < 10; i++ {
+		codec := SnappyCodec()
+		if i%2 == 1 {
+			codec = GZIPCodec()
+		}
+		ref, err := s.WriteWithCodec([]byte(fmt.Sprintf("store blob %d", i)), codec)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+	if refs[0].Less(pos) {
+		t.Errorf("first write should not be before the write position %s, but: %s", pos, refs[0])
+	}
+
+	ref, err := s.Write([]byte("last store blob"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	refs = append(refs, ref)
+
+	pos, err = s.WritePosition()
+	if err != nil {
+		t.Fatalf("write position: %v", err)
+	}
+	if !ref.Less(pos) {
+		t.Errorf("write position %s should be after the last write %s", pos, ref)
+	}
+
+	for i, ref := range refs[:10] {
+		b, err := s.Read(ref)
+		if err != nil {
+			t.Fatalf("read %s: %v", ref, err)
+		}
+		if string(b) != fmt.Sprintf("store blob %d", i) {
+			t.Errorf("read %s should give store blob %d, but: %q", ref, i, b)
+		}
+	}
+
+	_, err = s.Read(Ref{Fno: 99, Pos: fileHeaderSize})
+	if errors.Cause(err) != ErrInvalidRef {
+		t.Errorf("read of a missing blob should fail with ErrInvalidRef, but: %v", err)
+	}
+
+	c := s.Cursor(refs[2])
+	i := 2
+	for c.Next() {
+		if c.Ref() != refs[i] {
+			t.Errorf("cursor should be at %s, but: %s", refs[i], c.Ref())
+		}
+		b, err := c.Blob()
+		if err != nil {
+			t.Fatalf("cursor blob %s: %v", c.Ref(), err)
+		}
+		if c.Length() != uint32(len(b)) {
+			t.Errorf("cursor length %d should be the blob length %d", c.Length(), len(b))
+		}
+		if typ := [...]string{"SNAP", "GZIP"}[i%2]; i < 10 && c.Typ() != typ {
+			t.Errorf("cursor typ at %s should be %s, but: %s", c.Ref(), typ, c.Typ())
+		}
+		i++
+	}
+	if c.Error() != nil {
+		t.Errorf("cursor: %v", c.Error())
+	}
+	if i != len(refs) {
+		t.Errorf("cursor should have visited %d blobs, but: %d", len(refs)-2, i-2)
+	}
+}
+
+func Test_StoreDB(t *testing.T) {
+	db, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(db)
+
+	testStore(t, db)
+}
+
+func Test_StoreClient(t *testing.T) {
+	db, _ := openScanTestDB(t, 0)
+	defer closeScanTestDB(db)
+
+	// the first read of every ref fails
+	var requests int32
+	handler := NewHandler(db)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && atomic.AddInt32(&requests, 1)%2 == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cl := NewClient(srv.URL)
+	cl.RetryWait = 0
+	// several pages
+	cl.pageSize = 3
+
+	testStore(t, cl)
+
+	cl.Retries = 0
+	_, err := cl.WritePosition()
+	if err == nil {
+		t.Errorf("read without retries should fail")
+	}
+}
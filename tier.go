@@ -0,0 +1,196 @@
+package bobstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// coldDir gives the cold directory of data file fno, false if it is not cold
+func (m *manifest) coldDir(fno uint32) (string, bool) {
+	i := sort.Search(len(m.ColdFiles), func(i int) bool { return m.ColdFiles[i].Fno >= fno })
+	if i < len(m.ColdFiles) && m.ColdFiles[i].Fno == fno {
+		return m.ColdFiles[i].Dir, true
+	}
+	return "", false
+}
+
+// coldDirIndex gives the index of dir in ColdDirs, -1 if it is not one of them
+func (m *manifest) coldDirIndex(dir string) int {
+	for i, d := range m.ColdDirs {
+		if d == dir {
+			return i
+		}
+	}
+	return -1
+}
+
+// coldPath gives the cold directory, relative ones are relative to the db directory
+func coldPath(db *DB, dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(db.name, dir)
+}
+
+// x means mutex is acquired
+func xDataFileName(db *DB, fno uint32) string {
+	name := fmt.Sprintf("%05d", fno)
+	if db.manifest == nil {
+		return filepath.Join(db.name, name)
+	}
+	if dir, ok := db.manifest.coldDir(fno); ok {
+		return filepath.Join(coldPath(db, dir), name)
+	}
+	return filepath.Join(db.name, name)
+}
+
+// xReloadTiers reloads the manifest of a read-only db, the writer may have
+// moved files to the cold tier since.  It is true if there are new cold files.
+// x means mutex is acquired.
+func xReloadTiers(db *DB) bool {
+	if db.writer != nil || db.manifest == nil {
+		return false
+	}
+
+	n := len(db.manifest.ColdFiles)
+	return xReadManifest(db) == nil && len(db.manifest.ColdFiles) != n
+}
+
+// MigrateCold moves the data files last modified more than olderThan ago
+// to the cold directory coldDir, relative to the db directory if not absolute.
+// Only data files the writer is done with are moved, refs stay valid.
+//
+// The cold tier may span several directories, e.g. one per disk: the
+// manifest records the directory of every moved file.  Files already
+// in the cold tier stay where they are.
+//
+// A file is copied to the cold directory first, then the manifest
+// records it as cold and only then it is removed from the db directory.
+// Read-only dbs pick up the change when they do not find a file.
+// The db has to be opened read-write.  Returns the moved data files.
+func (db *DB) MigrateCold(coldDir string, olderThan time.Duration) ([]uint32, error) {
+	if db.writer == nil {
+		return nil, errors.New("opened read-only")
+	}
+
+	if coldDir == "" {
+		return nil, errors.New("no cold directory")
+	}
+
+	err := os.MkdirAll(coldPath(db, coldDir), 0777)
+	if err != nil {
+		return nil, errors.Wrap(err, "mkdir failed")
+	}
+
+	fnos, err := dataFiles(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// writes may still go to files before the one of the committed position
+	sealed := committedPosition(db).Fno
+	cutoff := time.Now().Add(-olderThan)
+
+	var moved []uint32
+	for _, fno := range fnos {
+		if fno >= sealed {
+			break
+		}
+
+		hot := filepath.Join(db.name, fmt.Sprintf("%05d", fno))
+		fi, err := os.Stat(hot)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+
+		db.lock.Lock()
+		_, cold := db.manifest.coldDir(fno)
+		db.lock.Unlock()
+		if cold {
+			// left over from an interrupted move
+			err = os.Remove(hot)
+			if err != nil {
+				return moved, err
+			}
+			continue
+		}
+		if fi.ModTime().After(cutoff) {
+			continue
+		}
+
+		err = copyToCold(hot, filepath.Join(coldPath(db, coldDir), fmt.Sprintf("%05d", fno)))
+		if err != nil {
+			return moved, err
+		}
+
+		db.lock.Lock()
+		if db.manifest.coldDirIndex(coldDir) == -1 {
+			db.manifest.ColdDirs = append(db.manifest.ColdDirs, coldDir)
+		}
+		db.manifest.ColdFiles = append(db.manifest.ColdFiles, coldFile{Fno: fno, Dir: coldDir})
+		sort.Slice(db.manifest.ColdFiles, func(i, j int) bool { return db.manifest.ColdFiles[i].Fno < db.manifest.ColdFiles[j].Fno })
+		err = xWriteManifest(db)
+		db.lock.Unlock()
+		if err != nil {
+			return moved, err
+		}
+
+		// open handles keep reading the removed file
+		err = os.Remove(hot)
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, fno)
+	}
+
+	return moved, nil
+}
+
+// copyToCold copies the file, the copy appears atomically under its name.
+// A hard link is used if both are on the same file system.
+func copyToCold(src, dst string) error {
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+
+	if os.Link(src, tmp) != nil {
+		err := copyFile(src, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	return errors.Wrap(os.Rename(tmp, dst), "move to cold tier")
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "move to cold tier")
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "move to cold tier")
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		return errors.Wrap(err, "move to cold tier")
+	}
+	return out.Close()
+}
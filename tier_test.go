@@ -0,0 +1,116 @@
+package bobstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_MigrateCold(t *testing.T) {
+	db, refs := openScanTestDB(t, 30)
+	defer closeScanTestDB(db)
+
+	// opened before the migration
+	ro, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer ro.Close()
+
+	fnos, _ := dataFiles(db)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, fno := range fnos[:2] {
+		os.Chtimes(dataFileName(db, fno), old, old)
+	}
+
+	moved, err := db.MigrateCold("cold", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if len(moved) != 2 || moved[0] != fnos[0] || moved[1] != fnos[1] {
+		t.Errorf("the 2 old files should have been moved, but: %v", moved)
+	}
+	for _, fno := range moved {
+		if _, err = os.Stat(filepath.Join(db.name, fmt.Sprintf("%05d", fno))); !os.IsNotExist(err) {
+			t.Errorf("data file %05d should be removed from the db directory: %v", fno, err)
+		}
+		if _, err = os.Stat(filepath.Join(db.name, "cold", fmt.Sprintf("%05d", fno))); err != nil {
+			t.Errorf("data file %05d should be in the cold directory: %v", fno, err)
+		}
+	}
+
+	reopened, err := Open(db.name)
+	if err != nil {
+		t.Fatalf("can not open db: %v", err)
+	}
+	defer reopened.Close()
+
+	for _, d := range []*DB{db, ro, reopened} {
+		for i, ref := range refs {
+			b, err := d.Read(ref)
+			if err != nil {
+				t.Fatalf("read %s: %v", ref, err)
+			}
+			if string(b) != fmt.Sprintf("blob number %d", i) {
+				t.Errorf("%s should be blob number %d, but: %q", ref, i, b)
+			}
+		}
+		n := 0
+		for c := d.Cursor(Ref{}); c.Next(); {
+			n++
+		}
+		if n != len(refs) {
+			t.Errorf("cursor should see %d blobs across tiers, but: %d", len(refs), n)
+		}
+	}
+
+	// a second cold directory
+	for _, fno := range fnos[2:4] {
+		os.Chtimes(dataFileName(db, fno), old, old)
+	}
+	colder := filepath.Join(os.TempDir(), filepath.Base(db.name)+".colder")
+	defer os.RemoveAll(colder)
+	moved, err = db.MigrateCold(colder, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if len(moved) != 2 || moved[0] != fnos[2] || moved[1] != fnos[3] {
+		t.Errorf("the 2 newly old files should have been moved, but: %v", moved)
+	}
+	for i, fno := range fnos[:4] {
+		dir := filepath.Join(db.name, "cold")
+		if i >= 2 {
+			dir = colder
+		}
+		if _, err = os.Stat(filepath.Join(dir, fmt.Sprintf("%05d", fno))); err != nil {
+			t.Errorf("data file %05d should be in %s: %v", fno, dir, err)
+		}
+	}
+	for _, d := range []*DB{db, ro} {
+		for i, ref := range refs {
+			b, err := d.Read(ref)
+			if err != nil || string(b) != fmt.Sprintf("blob number %d", i) {
+				t.Errorf("%s should be blob number %d, but: %q %v", ref, i, b, err)
+			}
+		}
+	}
+}
+
+func Test_ColdManifestUpgrade(t *testing.T) {
+	m := &manifest{ColdDirs: []string{"b"}, ColdFiles: []coldFile{{Fno: 5, Dir: "b"}}, ColdDir: "a", Cold: []uint32{1, 2}}
+	m.upgrade()
+
+	if len(m.ColdDirs) != 2 || m.ColdDirs[1] != "a" || m.ColdDir != "" || m.Cold != nil {
+		t.Errorf("the single cold directory should be added to the cold directories: %+v", m)
+	}
+	for fno, want := range map[uint32]string{1: "a", 2: "a", 5: "b"} {
+		if dir, ok := m.coldDir(fno); !ok || dir != want {
+			t.Errorf("data file %05d should be in %s, but: %q %v", fno, want, dir, ok)
+		}
+	}
+	if _, ok := m.coldDir(3); ok {
+		t.Errorf("data file 00003 should not be cold")
+	}
+}
@@ -1,9 +1,13 @@
 package bobstore
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -13,31 +17,86 @@ import (
 // this means a single blob may not be larger than 1GB - headerSize
 const MaxFileLength = 1024 * 1024 * 1024
 
-// MaxNumberFiles is 64k
+// MaxNumberFiles is 64k, the limit of v1 refs
 const MaxNumberFiles = 0xFFFF
 
+// MaxNumberFilesV2 is 4G, the limit of v2 refs and the default of DB.MaxFiles
+const MaxNumberFilesV2 = 0xFFFFFFFF
+
 // headerSize 16 bytes
 const headerSize = 16
 
+// header flags
+const (
+	// flagJSON marks the blob as validated JSON, see JSONWriter
+	flagJSON = 1 << iota
+
+	// flagCRC marks records with a checksum, see DB.Checksums
+	flagCRC
+
+	// flagEncrypted marks encrypted records, see Encrypted
+	flagEncrypted
+)
+
+// knownFlags are all flags understood by this version
+const knownFlags = flagJSON | flagCRC | flagEncrypted
+
+// crcSize is the size of the optional checksum following the compressed bytes
+const crcSize = 4
+
 // the header precdes every blob
 type header struct {
 	// typ - one of BLOB (plain blob), SNAP (snap compressed), GZIP (gzip compressed)
 	Typ [4]byte
 
-	// reserved for alignment purposes
-	_ uint32
+	// flags - see flagJSON etc, 0 for plain blobs
+	Flags uint16
+
+	// length of the metadata section following the header
+	// 0 if the blob has no metadata
+	MetaLength uint16
 
 	// uncompressed length
 	Length uint32
 
 	// compressed length
-	// compressed bytes follow, followed by padding rouding up to 8
+	// metadata and compressed bytes follow, then the optional checksum,
+	// followed by padding rouding up to 8
 	// i.e. a header is always 64bit aligned
 	Compressed uint32
 }
 
 type headerBytes [headerSize]byte
 
+// bodySize is the size of metadata, compressed bytes and checksum
+func (h *header) bodySize() uint64 {
+	size := uint64(h.MetaLength) + uint64(h.Compressed)
+	if h.Flags&flagCRC != 0 {
+		size += crcSize
+	}
+	return size
+}
+
+// recordSize is the size of header, metadata, compressed bytes and checksum
+// rounded up to the next multiple of 8
+func (h *header) recordSize() uint64 {
+	return (headerSize + h.bodySize() + 7) &^ 7
+}
+
+// fits is true if the record at pos ends within a data file of maxLength bytes.
+// Garbage headers give sizes that do not.
+func (h *header) fits(pos, maxLength uint32) bool {
+	return uint64(pos)+h.recordSize() <= uint64(maxLength)
+}
+
+// checksum is the CRC-32C of header, metadata and compressed bytes
+func (h *header) checksum(body []byte) uint32 {
+	crc := crc32.Update(0, crcTable, (*headerBytes)(unsafe.Pointer(h))[:])
+	return crc32.Update(crc, crcTable, body)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // WritePosition gives the current write position (where the next write would be)
 // only implemented if opened read-write
 func (db *DB) WritePosition() (ref Ref, err error) {
@@ -63,20 +122,55 @@ func (db *DB) Write(b []byte) (Ref, error) {
 
 // WriteWithCodec - write the blob with explicit codec.
 func (db *DB) WriteWithCodec(b []byte, codec *Codec) (Ref, error) {
+	return db.write(b, codec, nil, 0)
+}
+
+// WriteWithMeta - write the blob with explicit codec and metadata.
+// The metadata is stored uncompressed between header and blob,
+// it can be read without decoding the blob (see Cursor.Meta).
+func (db *DB) WriteWithMeta(b []byte, codec *Codec, meta Meta) (Ref, error) {
+	mb, err := meta.encode()
+	if err != nil {
+		return Ref{}, err
+	}
+	return db.write(b, codec, mb, 0)
+}
+
+func (db *DB) write(b []byte, codec *Codec, meta []byte, flags uint16) (Ref, error) {
 	var ref Ref
 
-	dst, err := codec.encoder(b)
+	if codec == nil {
+		return ref, errors.New("no codec")
+	}
+
+	// codec may choose another codec, see AutoCodec
+	used, dst, err := codec.encode(b)
 	if err != nil {
 		return ref, errors.Wrapf(err, "encoding %s", codec.typ)
 	}
+	codec = used
+
+	if codec.stages != nil {
+		err = recordPipeline(db, codec)
+		if err != nil {
+			return ref, errors.Wrap(err, "record pipeline")
+		}
+	}
 
-	h := header{Length: uint32(len(b)), Compressed: uint32(len(dst))}
+	flags |= codec.flags
+	if db.Checksums {
+		flags |= flagCRC
+	}
+
+	h := header{Flags: flags, Length: uint32(len(b)), Compressed: uint32(len(dst)), MetaLength: uint16(len(meta))}
 	copy(h.Typ[:], []byte(codec.typ))
 
 	f, ref, err := reserve(db, &h)
 	if err != nil {
 		return ref, errors.Wrap(err, "reserve")
 	}
+	defer written(db, ref)
+	ref = db.extendedRef(ref.Fno, ref.Pos, &h)
 
 	// XXX: errors here will leave a  blob with errors
 	// maybe we should hold the mutex for the whole write, after all
@@ -87,16 +181,33 @@ func (db *DB) WriteWithCodec(b []byte, codec *Codec) (Ref, error) {
 		return ref, errors.Wrap(err, "compress failed")
 	}
 
-	sizeWithPadding := (len(dst) + 7) & 0xFFFFFFF8
-	if cap(dst) < sizeWithPadding {
+	body := dst
+	if len(meta) > 0 || h.Flags&flagCRC != 0 {
+		body = make([]byte, 0, h.recordSize()-headerSize)
+		body = append(body, meta...)
+		body = append(body, dst...)
+	}
+	if h.Flags&flagCRC != 0 {
+		var cb [crcSize]byte
+		binary.LittleEndian.PutUint32(cb[:], h.checksum(body))
+		body = append(body, cb[:]...)
+	}
+
+	sizeWithPadding := int(h.recordSize() - headerSize)
+	if cap(body) < sizeWithPadding {
 		var b8 [8]byte
-		dst = append(dst, b8[:sizeWithPadding-len(dst)]...)
+		body = append(body, b8[:sizeWithPadding-len(body)]...)
 	}
-	_, err = f.WriteAt(dst[:sizeWithPadding], int64(ref.Pos+headerSize))
+	_, err = f.WriteAt(body[:sizeWithPadding], int64(ref.Pos+headerSize))
 	if err != nil {
 		return ref, errors.Wrap(err, "compress failed")
 	}
 
+	err = indexBlob(db, ref, b)
+	if err != nil {
+		return ref, errors.Wrap(err, "index failed")
+	}
+
 	return ref, nil
 }
 
@@ -104,61 +215,177 @@ func (db *DB) WriteWithCodec(b []byte, codec *Codec) (Ref, error) {
 // of the header and blob data.  the increasing of the write position has
 // to be protected by a mutex.
 func reserve(db *DB, h *header) (*os.File, Ref, error) {
+	var capacity *Capacity
 	db.lock.Lock()
-	defer db.lock.Unlock()
+	defer func() {
+		db.lock.Unlock()
+		// the callback may use the db
+		if capacity != nil {
+			db.OnSoftLimit(*capacity)
+		}
+	}()
+
+	err := xRecordMaxFiles(db)
+	if err != nil {
+		return nil, Ref{}, err
+	}
+
+	// header + metadata + compressed size rounded up to the next multiple of 8
+	need := h.recordSize()
+
+	// even an empty file has no space for it
+	if fileHeaderSize+need > uint64(db.MaxFileLength) {
+		return nil, Ref{}, errors.Errorf("record of %d bytes exceeds the maximum file length %d", need, db.MaxFileLength)
+	}
 
-	// header + compressed size rounded up to the next multiple of 8
-	need := (headerSize + h.Compressed + 7) & 0xFFFFFFF8
+	// a failed reservation leaves the write position as it was
+	prev := db.writePos
 
 	// next file if insufficient space
-	if db.writePos.Pos+need > db.MaxFileLength {
-		if db.writePos.Fno == MaxNumberFiles {
-			panic(fmt.Errorf("maximum number of files already in use: %d", MaxNumberFiles))
+	newFile := false
+	if !h.fits(db.writePos.Pos, db.MaxFileLength) {
+		if uint64(db.writePos.Fno)+1 >= uint64(db.MaxFiles) {
+			return nil, Ref{}, errors.Wrapf(ErrStoreFull, "maximum number of files already in use: %d", db.MaxFiles)
 		}
 		db.writePos.Fno++
 		db.writePos.Pos = 0
+		newFile = true
 	}
 
-	f, err := xGetFile(db, db.writePos.Fno)
+	dbf, err := xGetDataFile(db, db.writePos.Fno)
 	if err != nil {
+		db.writePos = prev
 		return nil, Ref{}, err
 	}
+	f := dbf.file
+
+	// a new file starts with the file header
+	if db.writePos.Pos < dbf.start {
+		db.writePos.Pos = dbf.start
+	}
 
 	// return the values before increasing the write position
 	pos := db.writePos.Pos
 
 	// increase write position
-	db.writePos.Pos += need
+	db.writePos.Pos += uint32(need)
 
 	// now write it
 	_, err = db.writer.WriteAt([]byte(db.writePos.String()), 0)
 	if err != nil {
+		db.writePos = prev
 		return nil, Ref{}, errors.Wrap(err, "write failed")
 	}
 
-	return f, Ref{Fno: db.writePos.Fno, Pos: pos}, nil
+	// only a successful reservation is written, see written
+	ref := Ref{Fno: db.writePos.Fno, Pos: pos}
+	db.pending = append(db.pending, ref)
+
+	// the new file is in use now
+	if newFile && overSoftLimit(db, db.writePos) {
+		c := capacityAt(db, db.writePos)
+		capacity = &c
+	}
+
+	return f, ref, nil
 }
 
-func getFile(db *DB, fno uint16) (*os.File, error) {
+// written removes the reserved record from the pending records
+func written(db *DB, ref Ref) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for i, p := range db.pending {
+		if p.Fno == ref.Fno && p.Pos == ref.Pos {
+			db.pending = append(db.pending[:i], db.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// committedPosition gives the position up to which all
+// records are completely written, in-flight writes are after it
+func committedPosition(db *DB) Ref {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if len(db.pending) > 0 {
+		return db.pending[0]
+	}
+	return db.writePos
+}
+
+func getFile(db *DB, fno uint32) (*os.File, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	return xGetFile(db, fno)
 }
 
-// x means mutex is acquired
-func xGetFile(db *DB, fno uint16) (*os.File, error) {
-	if f := db.files[fno]; f != nil {
-		return f.file, nil
+// fileExists checks if the data file exists without creating it
+func fileExists(db *DB, fno uint32) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.files[fno] != nil {
+		return true
 	}
 
-	f, err := os.OpenFile(filepath.Join(db.name, fmt.Sprintf("%05d", fno)), db.openflags, 0666)
+	_, err := os.Stat(xDataFileName(db, fno))
+	if os.IsNotExist(err) && xReloadTiers(db) {
+		_, err = os.Stat(xDataFileName(db, fno))
+	}
+	return err == nil
+}
+
+func dataFileName(db *DB, fno uint32) string {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return xDataFileName(db, fno)
+}
+
+// dataFiles lists the numbers of the data files of all tiers in ascending order
+func dataFiles(db *DB) ([]uint32, error) {
+	// at least 5 digits, more for file numbers beyond 99999
+	names, err := filepath.Glob(filepath.Join(db.name, "[0-9][0-9][0-9][0-9][0-9]*"))
 	if err != nil {
 		return nil, err
 	}
 
-	db.files[fno] = &dbFile{f}
+	fnos := make([]uint32, 0, len(names))
+	for _, name := range names {
+		fno, err := strconv.ParseUint(filepath.Base(name), 10, 32)
+		if err != nil {
+			continue
+		}
+		fnos = append(fnos, uint32(fno))
+	}
+
+	db.lock.Lock()
+	if db.manifest != nil {
+		for _, cf := range db.manifest.ColdFiles {
+			fnos = append(fnos, cf.Fno)
+		}
+	}
+	db.lock.Unlock()
+
+	// a file is in both directories while it is moved
+	sort.Slice(fnos, func(i, j int) bool { return fnos[i] < fnos[j] })
+	n := 0
+	for i, fno := range fnos {
+		if i == 0 || fno != fnos[n-1] {
+			fnos[n] = fno
+			n++
+		}
+	}
 
-	// XXX: mark file as recently used, close files that have been open too long
+	return fnos[:n], nil
+}
 
-	return f, nil
+// x means mutex is acquired
+func xGetFile(db *DB, fno uint32) (*os.File, error) {
+	dbf, err := xGetDataFile(db, fno)
+	if err != nil {
+		return nil, err
+	}
+	return dbf.file, nil
 }